@@ -0,0 +1,179 @@
+package rashdb
+
+import (
+	"reflect"
+
+	"github.com/thomastay/rash-db/pkg/app"
+)
+
+// Changing the columns of a table doesn't rewrite its rows. Rows are stored as records (see pkg/app/record.go),
+// where each column has a position:
+//   - Added columns go at the end, so rows that were written before have fewer columns, and read NULL for the new ones
+//   - Dropped columns keep their position, but are marked as dropped in the schema. Rows written afterwards
+//     store NULL in them, and their old values are skipped over when reading
+//   - Renaming a column only changes the schema
+//
+// CompactTable rewrites every row, which fills in added columns and removes dropped ones for good.
+// Every change bumps the version of the table's schema.
+
+// Adds a column to the end of a table, outside of any explicit transaction.
+// The change is only committed by SyncAll.
+func (db *DB) AddColumn(tableName string, columnName string, fieldType interface{}) error {
+	return db.implicitUpdate(func(tx *Tx) error {
+		return tx.AddColumn(tableName, columnName, fieldType)
+	})
+}
+
+// Drops a column of a table, outside of any explicit transaction.
+// The change is only committed by SyncAll.
+func (db *DB) DropColumn(tableName string, columnName string) error {
+	return db.implicitUpdate(func(tx *Tx) error {
+		return tx.DropColumn(tableName, columnName)
+	})
+}
+
+// Renames a column of a table, outside of any explicit transaction.
+// The change is only committed by SyncAll.
+func (db *DB) RenameColumn(tableName string, oldName string, newName string) error {
+	return db.implicitUpdate(func(tx *Tx) error {
+		return tx.RenameColumn(tableName, oldName, newName)
+	})
+}
+
+// Rewrites every row of a table, outside of any explicit transaction.
+// The change is only committed by SyncAll.
+func (db *DB) CompactTable(tableName string) error {
+	return db.implicitUpdate(func(tx *Tx) error {
+		return tx.CompactTable(tableName)
+	})
+}
+
+// Adds a column to the end of a table. Its type is the type of fieldType, e.g. int64(0) or "", with the same rules as
+// the fields of the struct given to CreateTable. Rows that are already in the table read NULL for the new column.
+func (tx *Tx) AddColumn(tableName string, columnName string, fieldType interface{}) error {
+	table, err := tx.writableTable(tableName)
+	if err != nil {
+		return err
+	}
+	if columnName == "" {
+		return ErrAlterTableInvalidColumn(columnName)
+	}
+	if _, ok := table.column(columnName); ok {
+		return ErrColumnExists
+	}
+	typ := reflect.TypeOf(fieldType)
+	if typ == nil {
+		return ErrInvalidTableValue
+	}
+	dataType, ok := columnType(typ)
+	if !ok {
+		return ErrInvalidTableValue
+	}
+	table.schema.Columns = append(table.schema.Columns, app.TableColumn{Key: columnName, Value: dataType})
+	table.schemaChanged()
+	return nil
+}
+
+// Drops a column of a table. Primary key columns and indexed columns can't be dropped.
+// The values of the column stay on disk until the table is compacted.
+func (tx *Tx) DropColumn(tableName string, columnName string) error {
+	table, err := tx.writableTable(tableName)
+	if err != nil {
+		return err
+	}
+	col := findColumn(table.schema.Columns, columnName)
+	if col == nil {
+		return ErrAlterTableInvalidColumn(columnName)
+	}
+	for _, idx := range table.indexes {
+		if findColumn(idx.schema.Columns, columnName) != nil {
+			return ErrColumnIndexed
+		}
+	}
+	col.Dropped = true
+	table.schemaChanged()
+	return nil
+}
+
+// Renames a column of a table, which may be part of the primary key. Indexes on the column keep working, and the ones
+// that were created for its unique and index options are renamed with it.
+func (tx *Tx) RenameColumn(tableName string, oldName string, newName string) error {
+	table, err := tx.writableTable(tableName)
+	if err != nil {
+		return err
+	}
+	col := findColumn(table.schema.PrimaryKey, oldName)
+	if col == nil {
+		col = findColumn(table.schema.Columns, oldName)
+	}
+	if col == nil || newName == "" {
+		return ErrAlterTableInvalidColumn(oldName)
+	}
+	if _, ok := table.column(newName); ok {
+		return ErrColumnExists
+	}
+	// The indexes that were generated for the column are renamed with it, so that its old name can be used again
+	indexNames, err := tx.generatedIndexNames(table, table.schema.Name, oldName, newName)
+	if err != nil {
+		return err
+	}
+	err = tx.renameIndexes(table, indexNames)
+	if err != nil {
+		return err
+	}
+	col.Key = newName
+	for _, idx := range table.indexes {
+		if idxCol := findColumn(idx.schema.Columns, oldName); idxCol != nil {
+			idxCol.Key = newName
+			idx.dirty = true
+		}
+	}
+	table.schemaChanged()
+	return nil
+}
+
+// Rewrites every row of a table with its current columns. Rows that were written before columns were added get
+// them filled in, and dropped columns are removed from the rows and from the schema.
+// Every row is held in memory while the table is rewritten.
+func (tx *Tx) CompactTable(tableName string) error {
+	table, err := tx.writableTable(tableName)
+	if err != nil {
+		return err
+	}
+	compacted := *table.schema
+	compacted.Columns = table.schema.LiveColumns()
+	var rows []*app.KeyValue
+	err = table.tree.ForEach(func(kv *app.KeyValue) error {
+		row, err := app.DecodeKeyValue(table.schema, kv)
+		if err != nil {
+			return err
+		}
+		newKV, err := app.EncodeKeyValue(&compacted, row)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, newKV)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// The tree can't change while it's being walked, so the rows are replaced afterwards
+	for _, kv := range rows {
+		_, err = table.tree.Update(kv)
+		if err != nil {
+			return err
+		}
+	}
+	table.syncRoot()
+	table.schema.Columns = compacted.Columns
+	table.schemaChanged()
+	return nil
+}
+
+// Records that the columns of the table changed
+func (tbl *tableNode) schemaChanged() {
+	tbl.schema.Version++
+	tbl.columns = columnsMap(tbl.schema)
+	tbl.dirty = true
+}
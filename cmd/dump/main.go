@@ -39,32 +39,75 @@ func run() error {
 	out := NewStreamer(bufferedStdout)
 
 	out.StreamObjOpen("")
+	// Commits that are still in the log aren't replayed, since that would write to the DB file
+	if info, err := os.Stat(filename + "-wal"); err == nil && info.Size() > 0 {
+		out.StreamKV("Note", "only the checkpointed state is shown, the commits in "+filename+"-wal are not")
+	}
 	out.StreamObjOpen("Header")
 	out.StreamKV("Magic", string(header.Magic[:15]))
 	out.StreamKV("Version", header.Version)
 	out.StreamKV("PageSize", header.PageSize)
 	out.StreamKV("NumPages", header.NumPages)
+	out.StreamKV("FreelistTrunk", header.FreelistTrunk)
+	out.StreamKV("FreelistCount", header.FreelistCount)
 	out.StreamObjClose(true)
 	out.StreamArrOpen("Tables")
-	out.StreamObjOpen("")
 	pageSize := int(header.PageSize)
+	// Only used to read pages, and the overflow pages of large keys and values
+	pager := app.NewPager(pageSize, file)
 
-	table, err := parseTable(file, pageSize)
+	tables, err := app.ListSchemas(app.OpenSchemaTree(pager))
 	if err != nil {
 		return err
 	}
+	for i := range tables {
+		indexes, err := app.ListIndexes(app.OpenSchemaTree(pager), tables[i].Name)
+		if err != nil {
+			return err
+		}
+		err = dumpTable(out, file, &tables[i], indexes, pager)
+		if err != nil {
+			return err
+		}
+	}
+	out.StreamArrClose()      // end tables
+	out.StreamObjClose(false) // end
+	return nil
+}
+
+func dumpTable(out *Streamer, file *os.File, table *app.TableSchema, indexes []app.IndexSchema, pager *app.Pager) error {
+	out.StreamObjOpen("")
 	out.StreamKV("Name", table.Name)
-	// feat: multi primary key
-	out.StreamKV("PrimaryKey", table.PrimaryKey[0].Key)
+	primaryKey := make([]string, len(table.PrimaryKey))
+	for i, col := range table.PrimaryKey {
+		primaryKey[i] = col.Key
+	}
+	out.StreamKV("PrimaryKey", primaryKey)
+	out.StreamKV("Version", table.Version)
+	if table.AutoIncrementKey() != nil {
+		out.StreamKV("Sequence", table.Sequence)
+	}
 	out.StreamArrOpen("Cols")
-	for _, col := range table.Columns {
+	for _, col := range table.LiveColumns() {
 		out.StreamObjOpen("")
 		out.StreamKV(col.Key, col.Value.String())
 		out.StreamObjClose(true)
 	}
 	out.StreamArrClose()
+	out.StreamArrOpen("Indexes")
+	for _, index := range indexes {
+		out.StreamObjOpen("")
+		out.StreamKV("Name", index.Name)
+		cols := make([]string, len(index.Columns))
+		for i, col := range index.Columns {
+			cols[i] = col.Key
+		}
+		out.StreamKV("Columns", cols)
+		out.StreamObjClose(true)
+	}
+	out.StreamArrClose()
 
-	kvs, err := parseTableData(file, table, 2, pageSize)
+	kvs, err := parseTableData(file, table, table.Root, pager)
 	if err != nil {
 		return err
 	}
@@ -78,10 +121,8 @@ func run() error {
 		}
 		out.StreamObjClose(true)
 	}
-	out.StreamArrClose()      // end data
-	out.StreamObjClose(true)  // end table
-	out.StreamArrClose()      // end tables
-	out.StreamObjClose(false) // end
+	out.StreamArrClose()     // end data
+	out.StreamObjClose(true) // end table
 	return nil
 }
 
@@ -94,24 +135,8 @@ func parseHeader(buf []byte) (disk.Header, error) {
 	return header, nil
 }
 
-func parseTable(file *os.File, pageSize int) (*app.TableSchema, error) {
-	file.Seek(0, io.SeekStart)
-	buf, err := common.ReadExactly(file, pageSize)
-	if err != nil {
-		return nil, err
-	}
-	page, err := disk.Decode(buf, pageSize, 1)
-	if err != nil {
-		return nil, err
-	}
-	tables, err := app.DecodeSchemaPage(page)
-	if err != nil {
-		return nil, err
-	}
-	return &tables[0], nil
-}
-
-func parseTableData(file *os.File, tbl *app.TableSchema, pageID int, pageSize int) ([]*app.TableKeyValue, error) {
+func parseTableData(file *os.File, tbl *app.TableSchema, pageID int, pager *app.Pager) ([]*app.TableKeyValue, error) {
+	pageSize := pager.PageSize
 	startOffset := (pageID - 1) * pageSize
 
 	buf := make([]byte, pageSize)
@@ -126,5 +151,25 @@ func parseTableData(file *os.File, tbl *app.TableSchema, pageID int, pageSize in
 	if err != nil {
 		return nil, err
 	}
-	return app.DecodeKeyValuesOnPage(tbl, page)
+	switch page := page.(type) {
+	case *disk.LeafPage:
+		return app.DecodeKeyValuesOnPage(tbl, page, pager)
+	case *disk.InteriorPage:
+		// Walk the children in key order
+		kvs := make([]*app.TableKeyValue, 0)
+		for _, cell := range page.Cells {
+			childKvs, err := parseTableData(file, tbl, int(cell.LeftChild), pager)
+			if err != nil {
+				return nil, err
+			}
+			kvs = append(kvs, childKvs...)
+		}
+		childKvs, err := parseTableData(file, tbl, int(page.RightChild), pager)
+		if err != nil {
+			return nil, err
+		}
+		return append(kvs, childKvs...), nil
+	default:
+		return nil, errors.New("unknown page type")
+	}
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"errors"
+	"os"
+
 	rashdb "github.com/thomastay/rash-db"
 )
 
@@ -12,18 +15,24 @@ func main() {
 }
 
 func run() error {
+	// Start from an empty DB every time
+	for _, name := range []string{"db.db", "db.db-wal"} {
+		err := os.Remove(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
 	db, err := rashdb.Open("db.db", &rashdb.DBOpenOptions{
 		PageSize: 2048,
 	})
 	if err != nil {
 		return err
 	}
-	// TODO allow multiple keys as primary. We need symbol and timestamp
-	err = db.CreateTable("Bars", Bar{}, "Symbol")
+	err = db.CreateTable("Bars", Bar{}, "Symbol", "Timestamp")
 	if err != nil {
 		return err
 	}
-	err = db.Insert("Bars", Bar{
+	_, err = db.Insert("Bars", Bar{
 		Symbol:    "Lorem ipsum dolor sit amet, consectetur adipiscing elit. Fusce ullamcorper efficitur ligula sed sollicitudin. Nam laoreet varius metus et tristique. Morbi tincidunt elit scelerisque scelerisque venenatis. Vestibulum a neque eu turpis varius euismod vitae nec turpis. Aenean maximus sem ultricies porttitor tempus. Ut ornare feugiat dapibus. Etiam semper risus quam, eu placerat lorem cursus nec. Nulla sollicitudin orci quis ante laoreet dictum. Sed id felis purus. Quisque ipsum nunc, fringilla at fermentum id, scelerisque a tortor. Vestibulum a porttitor elit.  Mauris finibus semper est tempus mollis. Fusce tempus lacinia nisl, et aliquet erat tristique in. Morbi fermentum orci diam, ac facilisis nisl hendrerit et. Morbi varius enim ut nibh venenatis, tristique dapibus justo egestas. Duis interdum orci vel lorem faucibus gravida. Ut eleifend neque egestas elit tristique tempor. Curabitur condimentum a tellus ut molestie. Duis ut turpis ut neque ultrices aliquet nec vel nisi. Nunc urna eget.",
 		Timestamp: 1695885687,
 		Open:      400.0,
@@ -34,7 +43,7 @@ func run() error {
 	if err != nil {
 		return err
 	}
-	err = db.Insert("Bars", Bar{
+	_, err = db.Insert("Bars", Bar{
 		Symbol:    "SPY",
 		Timestamp: 1695885688,
 		Open:      400.0,
@@ -45,7 +54,7 @@ func run() error {
 	if err != nil {
 		return err
 	}
-	err = db.Insert("Bars", Bar{
+	_, err = db.Insert("Bars", Bar{
 		Symbol:    "HELE",
 		Timestamp: 1695885689,
 		Open:      105.0,
@@ -60,7 +69,7 @@ func run() error {
 	if err != nil {
 		return err
 	}
-	return nil
+	return db.Close()
 }
 
 type Bar struct {
@@ -0,0 +1,239 @@
+package rashdb
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/thomastay/rash-db/pkg/app"
+)
+
+// A cursor moves over the rows of a table in primary key order, e.g. to read every row in a range of keys.
+// Rows are only decoded when Scan is called.
+//
+// A cursor can also move over the rows in the order of an index, see IndexCursor.
+//
+// A cursor can only be used while its transaction is open, and is closed when the transaction ends.
+// The table must not be changed while a cursor is open on it.
+type Cursor struct {
+	tx    *Tx
+	table *tableNode
+	// Set for cursors that move in the order of an index
+	index  *indexNode
+	cursor *app.Cursor
+	// Set by Columns, to decode only some of the columns of each row
+	projection *app.Projection
+	// Set if the index holds every projected column, so rows don't have to be looked up in the table
+	indexProjection *app.Projection
+}
+
+// Opens a cursor on a table. It isn't on any row until it is moved with First, Last or Seek.
+func (tx *Tx) Cursor(tableName string) (*Cursor, error) {
+	if tx.done {
+		return nil, ErrTxClosed
+	}
+	table, err := tx.lookupTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	if table == nil {
+		return nil, ErrUnknownTableName
+	}
+	c := &Cursor{
+		tx:     tx,
+		table:  table,
+		cursor: table.tree.Cursor(),
+	}
+	tx.cursors = append(tx.cursors, c)
+	return c, nil
+}
+
+// Opens a cursor which moves over the rows of a table in the order of one of its indexes.
+// Seek takes the values of the indexed columns, instead of a primary key. Rows with the same indexed values
+// are in primary key order.
+func (tx *Tx) IndexCursor(tableName string, indexName string) (*Cursor, error) {
+	c, err := tx.Cursor(tableName)
+	if err != nil {
+		return nil, err
+	}
+	c.index = c.table.index(indexName)
+	if c.index == nil {
+		return nil, ErrUnknownIndexName
+	}
+	c.cursor = c.index.tree.Cursor()
+	return c, nil
+}
+
+// Moves to the first row. Returns false if the table is empty.
+func (c *Cursor) First() (bool, error) {
+	if c.tx.done {
+		return false, ErrTxClosed
+	}
+	return c.cursor.First()
+}
+
+// Moves to the last row. Returns false if the table is empty.
+func (c *Cursor) Last() (bool, error) {
+	if c.tx.done {
+		return false, ErrTxClosed
+	}
+	return c.cursor.Last()
+}
+
+// Moves to the first row whose primary key is greater than or equal to key. Returns false if there is no such row.
+// For tables with more than one primary key column, key must be a Key. It may have fewer values than there are
+// primary key columns, in which case the cursor moves to the first row whose key starts with those values.
+// Cursors on an index take the values of the indexed columns instead, in the same way.
+func (c *Cursor) Seek(key interface{}) (bool, error) {
+	if c.tx.done {
+		return false, ErrTxClosed
+	}
+	keyBytes, err := c.seekKey(key)
+	if err != nil {
+		return false, err
+	}
+	return c.cursor.Seek(keyBytes)
+}
+
+func (c *Cursor) seekKey(key interface{}) ([]byte, error) {
+	if c.index == nil {
+		return c.table.keyPrefix(key)
+	}
+	vals, ok := key.(Key)
+	if !ok {
+		vals = Key{key}
+	}
+	if len(vals) == 0 || len(vals) > len(c.index.schema.Columns) {
+		return nil, ErrKeyMismatch
+	}
+	vals, err := c.table.convertKey(c.index.schema.Columns, vals)
+	if err != nil {
+		return nil, err
+	}
+	return c.index.schema.EncodeKeyPrefix(vals)
+}
+
+// Moves to the next row. Returns false once the cursor moves past the last row.
+func (c *Cursor) Next() (bool, error) {
+	if c.tx.done {
+		return false, ErrTxClosed
+	}
+	return c.cursor.Next()
+}
+
+// Moves to the previous row. Returns false once the cursor moves past the first row.
+func (c *Cursor) Prev() (bool, error) {
+	if c.tx.done {
+		return false, ErrTxClosed
+	}
+	return c.cursor.Prev()
+}
+
+// Only decodes the given columns of each row from now on, and skips over the others.
+// Scan then only fills in the fields of those columns, and leaves the other fields as they are.
+// Calling Columns with no columns goes back to decoding every column.
+func (c *Cursor) Columns(names ...string) error {
+	if c.tx.done {
+		return ErrTxClosed
+	}
+	if len(names) == 0 {
+		c.projection = nil
+		c.indexProjection = nil
+		return nil
+	}
+	for i, name := range names {
+		if _, ok := c.table.column(name); !ok || containsString(names[:i], name) {
+			return ErrProjectionInvalidColumn(name)
+		}
+	}
+	projection, err := app.NewProjection(c.table.schema, names)
+	if err != nil {
+		return err
+	}
+	c.projection = projection
+	c.indexProjection = nil
+	if c.index != nil {
+		c.indexProjection = app.NewIndexProjection(c.table.schema, c.index.schema, names)
+	}
+	return nil
+}
+
+// Fills in dest with the row that the cursor is on.
+// dest must be a pointer to a struct of the same type that the table was created with.
+func (c *Cursor) Scan(dest interface{}) error {
+	if c.tx.done {
+		return ErrTxClosed
+	}
+	if !c.cursor.Valid() {
+		return ErrCursorNotOnRow
+	}
+	if !isStructPointer(dest) {
+		return ErrGetInvalidDest
+	}
+	if c.indexProjection != nil {
+		key, err := c.cursor.Key()
+		if err != nil {
+			return err
+		}
+		vals, err := c.indexProjection.Decode(&app.KeyValue{Key: key})
+		if err != nil {
+			return err
+		}
+		return c.table.setColumns(c.indexProjection.Names, vals, dest)
+	}
+	row, err := c.row()
+	if err != nil {
+		return err
+	}
+	if c.projection != nil {
+		vals, err := c.projection.Decode(row)
+		if err != nil {
+			return err
+		}
+		return c.table.setColumns(c.projection.Names, vals, dest)
+	}
+	return c.table.decodeRow(row, dest)
+}
+
+// The encoded row that the cursor is on
+func (c *Cursor) row() (*app.KeyValue, error) {
+	key, err := c.cursor.Key()
+	if err != nil {
+		return nil, err
+	}
+	if c.index != nil {
+		// The row itself is in the table, under the primary key at the end of the index key
+		_, key, err = c.index.schema.DecodeKey(key)
+		if err != nil {
+			return nil, err
+		}
+		val, found, err := c.table.tree.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, errMissingIndexedRow
+		}
+		return &app.KeyValue{Key: key, Val: val}, nil
+	}
+	val, err := c.cursor.Value()
+	if err != nil {
+		return nil, err
+	}
+	return &app.KeyValue{Key: key, Val: val}, nil
+}
+
+// Whether the key that the cursor is on starts with prefix
+func (c *Cursor) hasPrefix(prefix []byte) (bool, error) {
+	key, err := c.cursor.Key()
+	if err != nil {
+		return false, err
+	}
+	return bytes.HasPrefix(key, prefix), nil
+}
+
+// Lets go of the pages that the cursor is reading. The cursor can still be moved again afterwards.
+func (c *Cursor) Close() {
+	c.cursor.Close()
+}
+
+var errMissingIndexedRow = errors.New("index refers to a row that is not in the table")
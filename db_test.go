@@ -1,8 +1,20 @@
 package rashdb_test
 
 import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
 	"testing"
 
+	rashdb "github.com/thomastay/rash-db"
+	"github.com/thomastay/rash-db/pkg/app"
 	"github.com/thomastay/rash-db/pkg/disk"
 )
 
@@ -26,3 +38,2571 @@ func TestReadWriteHeaders(t *testing.T) {
 		t.Fatalf("Magic header not set, got %d", readHeader.Magic)
 	}
 }
+
+type testBar struct {
+	Symbol    string
+	Timestamp uint64
+	Open      float64
+	Close     float64
+	Tags      []string
+	Raw       []byte
+}
+
+func openTestDB(t *testing.T) *rashdb.DB {
+	db, err := rashdb.Open(filepath.Join(t.TempDir(), "test.db"), &rashdb.DBOpenOptions{
+		PageSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestInsertGet(t *testing.T) {
+	db := openTestDB(t)
+	err := db.CreateTable("Bars", testBar{}, "Symbol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		_, err = db.Insert("Bars", testBar{
+			Symbol:    fmt.Sprintf("SYM%d", i),
+			Timestamp: uint64(1695885687 + i),
+			Open:      float64(i) + 0.5,
+			Tags:      []string{"a", fmt.Sprint(i)},
+			Raw:       []byte{byte(i)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bar testBar
+	err = db.Get("Bars", "SYM123", &bar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := testBar{
+		Symbol:    "SYM123",
+		Timestamp: 1695885687 + 123,
+		Open:      123.5,
+		Tags:      []string{"a", "123"},
+		Raw:       []byte{123},
+	}
+	if !reflect.DeepEqual(bar, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, bar)
+	}
+
+	_, err = db.Insert("Bars", testBar{Symbol: "SYM123"})
+	if err != rashdb.ErrDuplicateKey {
+		t.Fatalf("Expected ErrDuplicateKey, got %v", err)
+	}
+
+	err = db.Get("Bars", "NOPE", &bar)
+	if err != rashdb.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	err = db.Get("Bars", "SYM1", bar)
+	if err != rashdb.ErrGetInvalidDest {
+		t.Fatalf("Expected ErrGetInvalidDest, got %v", err)
+	}
+}
+
+func TestCompositePrimaryKey(t *testing.T) {
+	db := openTestDB(t)
+	err := db.CreateTable("Bars", testBar{}, "Symbol", "Timestamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, symbol := range []string{"SPY", "HELE", "QQQ"} {
+		for ts := uint64(0); ts < 100; ts++ {
+			_, err = db.Insert("Bars", testBar{Symbol: symbol, Timestamp: ts, Close: float64(ts)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	_, err = db.Insert("Bars", testBar{Symbol: "SPY", Timestamp: 42})
+	if err != rashdb.ErrDuplicateKey {
+		t.Fatalf("Expected ErrDuplicateKey, got %v", err)
+	}
+
+	var bar testBar
+	err = db.Get("Bars", rashdb.Key{"HELE", 42}, &bar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bar.Symbol != "HELE" || bar.Timestamp != 42 || bar.Close != 42 {
+		t.Fatalf("Got the wrong bar %+v", bar)
+	}
+	err = db.Get("Bars", "HELE", &bar)
+	if err != rashdb.ErrKeyMismatch {
+		t.Fatalf("Expected ErrKeyMismatch, got %v", err)
+	}
+
+	err = db.CreateTable("Other", testBar{}, "Symbol", "Nope")
+	if err == nil {
+		t.Fatal("Expected an error for an unknown primary key column")
+	}
+}
+
+func TestManyTables(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := rashdb.Open(path, &rashdb.DBOpenOptions{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Far more schemas than fit on the first page
+	const numTables = 60
+	for i := 0; i < numTables; i++ {
+		name := fmt.Sprintf("Table%03d", i)
+		err = db.CreateTable(name, testBar{}, "Symbol", "Timestamp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j <= i%5; j++ {
+			_, err = db.Insert(name, testBar{Symbol: name, Timestamp: uint64(j)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err = db.CreateTable("Table007", testBar{}, "Symbol")
+	if err != rashdb.ErrTableExists {
+		t.Fatalf("Expected ErrTableExists, got %v", err)
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read every table back from the file
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	pager := app.NewPager(1024, file)
+	schemas, err := app.ListSchemas(app.OpenSchemaTree(pager))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schemas) != numTables {
+		t.Fatalf("Expected %d tables, got %d", numTables, len(schemas))
+	}
+	for i, schema := range schemas {
+		name := fmt.Sprintf("Table%03d", i)
+		if schema.Name != name {
+			t.Fatalf("Expected table %s, got %s", name, schema.Name)
+		}
+		numRows := 0
+		err = app.NewBTree(schema.Root, pager).ForEach(func(kv *app.KeyValue) error {
+			numRows++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if numRows != i%5+1 {
+			t.Fatalf("Table %s has %d rows, expected %d", name, numRows, i%5+1)
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := rashdb.DBOpenOptions{PageSize: 1024}
+	db, err := rashdb.Open(path, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"A", "B"} {
+		err = db.CreateTable(name, testBar{}, "Symbol")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert := func(db *rashdb.DB, from, to int) {
+		for i := from; i < to; i++ {
+			for _, name := range []string{"A", "B"} {
+				_, err := db.Insert(name, testBar{Symbol: fmt.Sprint(i), Timestamp: uint64(i), Tags: []string{name}})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	insert(db, 0, 200)
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Any page size in the options is ignored, the DB keeps its own.
+	// Rows are added after reopening, which must not overwrite any of the existing pages
+	options = rashdb.DBOpenOptions{PageSize: 4096, MustExist: true}
+	for round := 1; round <= 2; round++ {
+		db, err = rashdb.Open(path, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		insert(db, round*200, (round+1)*200)
+		err = db.SyncAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err = rashdb.Open(path, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 600; i++ {
+		for _, name := range []string{"A", "B"} {
+			var bar testBar
+			err = db.Get(name, fmt.Sprint(i), &bar)
+			if err != nil {
+				t.Fatalf("%s %d: %v", name, i, err)
+			}
+			if bar.Timestamp != uint64(i) || bar.Tags[0] != name {
+				t.Fatalf("%s %d: unexpected row %+v", name, i, bar)
+			}
+		}
+	}
+	err = db.CreateTable("A", testBar{}, "Symbol")
+	if err != rashdb.ErrTableExists {
+		t.Fatalf("Expected ErrTableExists, got %v", err)
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	dir := t.TempDir()
+	_, err := rashdb.Open(filepath.Join(dir, "missing.db"), &rashdb.DBOpenOptions{MustExist: true})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected a not exist error, got %v", err)
+	}
+
+	notADB := filepath.Join(dir, "notadb.db")
+	err = os.WriteFile(notADB, bytes.Repeat([]byte("not a database"), 1000), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rashdb.Open(notADB, nil)
+	if err != rashdb.ErrInvalid {
+		t.Fatalf("Expected ErrInvalid, got %v", err)
+	}
+
+	// A DB whose pages were cut off
+	path := filepath.Join(dir, "test.db")
+	db, err := rashdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	err = os.Truncate(path, disk.DBHeaderSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rashdb.Open(path, nil)
+	if err != rashdb.ErrInvalid {
+		t.Fatalf("Expected ErrInvalid, got %v", err)
+	}
+}
+
+func TestOpenStrayWAL(t *testing.T) {
+	dir := t.TempDir()
+	// Keep the log of a DB that is still open
+	path := filepath.Join(dir, "test.db")
+	db, err := rashdb.Open(path, &rashdb.DBOpenOptions{PageSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := os.ReadFile(path + "-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) == 0 {
+		t.Fatal("Expected the log to have commits in it")
+	}
+	db.Close()
+
+	// The log must not be replayed into a file that isn't a DB
+	notADB := filepath.Join(dir, "notadb.db")
+	contents := bytes.Repeat([]byte("not a database"), 1000)
+	err = os.WriteFile(notADB, contents, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(notADB+"-wal", log, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rashdb.Open(notADB, nil)
+	if err != rashdb.ErrInvalid {
+		t.Fatalf("Expected ErrInvalid, got %v", err)
+	}
+	got, err := os.ReadFile(notADB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Fatal("Expected the file to be left alone")
+	}
+
+	// Nor into a DB with a different page size
+	smallPath := filepath.Join(dir, "small.db")
+	db, err = rashdb.Open(smallPath, &rashdb.DBOpenOptions{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	contents, err = os.ReadFile(smallPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(smallPath+"-wal", log, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rashdb.Open(smallPath, nil)
+	if err != rashdb.ErrInvalid {
+		t.Fatalf("Expected ErrInvalid, got %v", err)
+	}
+	got, err = os.ReadFile(smallPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Fatal("Expected the DB to be left alone")
+	}
+}
+
+func TestCorruptSchemaRow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := rashdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateTable("Bars", testBar{}, "Symbol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Break the JSON of the primary key columns
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(b, []byte(`[["Symbol"`))
+	if i < 0 {
+		t.Fatal("Expected to find the primary key in the file")
+	}
+	b[i] = '{'
+	err = os.WriteFile(path, b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = rashdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var bar testBar
+	err = db.Get("Bars", "SPY", &bar)
+	if !errors.Is(err, rashdb.ErrInvalid) || !errors.Is(err, app.ErrCorruptSchema) {
+		t.Fatalf("Expected ErrInvalid, got %v", err)
+	}
+	_, err = db.Insert("Bars", testBar{Symbol: "SPY"})
+	if !errors.Is(err, rashdb.ErrInvalid) {
+		t.Fatalf("Expected ErrInvalid, got %v", err)
+	}
+}
+
+func TestInsertIntoReopenedTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	reopen := func() *rashdb.DB {
+		db, err := rashdb.Open(path, &rashdb.DBOpenOptions{PageSize: 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	// The table fits on its root page, which is the page that would be overwritten
+	db := reopen()
+	err := db.CreateTable("Bars", testBar{}, "Symbol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbols := []string{"SPY", "HELE", "QQQ"}
+	for i, symbol := range symbols {
+		if i > 0 {
+			db = reopen()
+		}
+		_, err = db.Insert("Bars", testBar{Symbol: symbol, Timestamp: uint64(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.SyncAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+
+	db = reopen()
+	defer db.Close()
+	for i, symbol := range symbols {
+		var bar testBar
+		err = db.Get("Bars", symbol, &bar)
+		if err != nil {
+			t.Fatalf("%s: %v", symbol, err)
+		}
+		if bar.Timestamp != uint64(i) {
+			t.Fatalf("%s: unexpected row %+v", symbol, bar)
+		}
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := rashdb.Open(path, &rashdb.DBOpenOptions{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateTable("Bars", testBar{}, "Symbol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := func(from, to int) {
+		for i := from; i < to; i++ {
+			_, err := db.Insert("Bars", testBar{Symbol: fmt.Sprint(i), Timestamp: uint64(i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := db.SyncAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert(0, 100)
+	info, err := os.Stat(path + "-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(100, 200)
+	// Crash in the middle of writing the second commit, without closing the DB
+	err = os.Truncate(path+"-wal", info.Size()+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = rashdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var bar testBar
+	for i := 0; i < 200; i++ {
+		err = db.Get("Bars", fmt.Sprint(i), &bar)
+		if i < 100 && err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if i >= 100 && err != rashdb.ErrKeyNotFound {
+			t.Fatalf("%d: expected the second commit to be lost, got %v", i, err)
+		}
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := rashdb.Open(path, &rashdb.DBOpenOptions{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *rashdb.Tx) error {
+		err := tx.CreateTable("Bars", testBar{}, "Symbol")
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			_, err = tx.Insert("Bars", testBar{Symbol: fmt.Sprint(i), Timestamp: uint64(i)})
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Delete("Bars", "42")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything in a failed transaction is thrown away, including new tables and pages
+	errFailed := errors.New("failed")
+	err = db.Update(func(tx *rashdb.Tx) error {
+		err := tx.CreateTable("Other", testBar{}, "Symbol")
+		if err != nil {
+			return err
+		}
+		for i := 100; i < 300; i++ {
+			_, err = tx.Insert("Bars", testBar{Symbol: fmt.Sprint(i)})
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.Delete("Bars", "7")
+		if err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("Expected the transaction to fail, got %v", err)
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Begin(true); err != rashdb.ErrTxInProgress {
+		t.Fatalf("Expected ErrTxInProgress, got %v", err)
+	}
+	if _, err = db.Insert("Bars", testBar{Symbol: "x"}); err != rashdb.ErrTxInProgress {
+		t.Fatalf("Expected ErrTxInProgress, got %v", err)
+	}
+	if err = tx.Delete("Bars", "42"); err != rashdb.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	_, err = tx.Insert("Bars", testBar{Symbol: "rolled back"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != rashdb.ErrTxClosed {
+		t.Fatalf("Expected ErrTxClosed, got %v", err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = rashdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.View(func(tx *rashdb.Tx) error {
+		if _, err := tx.Insert("Bars", testBar{Symbol: "x"}); err != rashdb.ErrTxNotWritable {
+			t.Fatalf("Expected ErrTxNotWritable, got %v", err)
+		}
+		var bar testBar
+		for i := 0; i < 300; i++ {
+			err := tx.Get("Bars", fmt.Sprint(i), &bar)
+			exists := i < 100 && i != 42
+			if exists && (err != nil || bar.Timestamp != uint64(i)) {
+				t.Fatalf("%d: expected the committed row, got %+v, %v", i, bar, err)
+			}
+			if !exists && err != rashdb.ErrKeyNotFound {
+				t.Fatalf("%d: expected ErrKeyNotFound, got %v", i, err)
+			}
+		}
+		if err := tx.Get("Bars", "rolled back", &bar); err != rashdb.ErrKeyNotFound {
+			t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+		}
+		return tx.Get("Other", "0", &bar)
+	})
+	if err != rashdb.ErrUnknownTableName {
+		t.Fatalf("Expected the table to have been rolled back, got %v", err)
+	}
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	err := db.Update(func(tx *rashdb.Tx) error {
+		return tx.CreateTable("Bars", testBar{}, "Symbol", "Timestamp")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every commit inserts a whole batch. Readers must see all of a batch, or none of it
+	const numBatches, batchSize = 50, 10
+	done := make(chan error)
+	go func() {
+		for b := 0; b < numBatches; b++ {
+			err := db.Update(func(tx *rashdb.Tx) error {
+				for i := 0; i < batchSize; i++ {
+					_, err := tx.Insert("Bars", testBar{Symbol: fmt.Sprint(b), Timestamp: uint64(i)})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	readErrs := make(chan error, 4)
+	for r := 0; r < cap(readErrs); r++ {
+		go func() {
+			for n := 0; n < 20; n++ {
+				err := db.View(func(tx *rashdb.Tx) error {
+					for b := 0; b < numBatches; b++ {
+						seen := 0
+						for i := 0; i < batchSize; i++ {
+							var bar testBar
+							err := tx.Get("Bars", rashdb.Key{fmt.Sprint(b), uint64(i)}, &bar)
+							if err == nil {
+								seen++
+							} else if err != rashdb.ErrKeyNotFound {
+								return err
+							}
+						}
+						if seen != 0 && seen != batchSize {
+							return fmt.Errorf("saw %d rows of batch %d", seen, b)
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					readErrs <- err
+					return
+				}
+			}
+			readErrs <- nil
+		}()
+	}
+	for r := 0; r < cap(readErrs); r++ {
+		if err := <-readErrs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot from before every batch still sees an empty table
+	var bar testBar
+	for b := 0; b < numBatches; b++ {
+		if err = old.Get("Bars", rashdb.Key{fmt.Sprint(b), uint64(0)}, &bar); err != rashdb.ErrKeyNotFound {
+			t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+		}
+	}
+	err = old.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx *rashdb.Tx) error {
+		return tx.Get("Bars", rashdb.Key{fmt.Sprint(numBatches - 1), uint64(batchSize - 1)}, &bar)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reads the header of a closed database
+func readTestHeader(t *testing.T, path string) disk.Header {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	b := make([]byte, disk.DBHeaderSize)
+	_, err = file.ReadAt(b, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header disk.Header
+	err = header.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+func TestFreelist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := rashdb.DBOpenOptions{PageSize: 1024}
+	readHeader := func() disk.Header {
+		return readTestHeader(t, path)
+	}
+	const numRows = 300
+	insertAll := func(db *rashdb.DB) {
+		err := db.Update(func(tx *rashdb.Tx) error {
+			for i := 0; i < numRows; i++ {
+				_, err := tx.Insert("Bars", testBar{Symbol: fmt.Sprint(i), Raw: bytes.Repeat([]byte{byte(i)}, 300)})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := rashdb.Open(path, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *rashdb.Tx) error {
+		return tx.CreateTable("Bars", testBar{}, "Symbol")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertAll(db)
+	err = db.Update(func(tx *rashdb.Tx) error {
+		for i := 0; i < numRows; i++ {
+			err := tx.Delete("Bars", fmt.Sprint(i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := readHeader()
+	if header.FreelistCount < numRows/3 || header.FreelistTrunk == 0 {
+		t.Fatalf("Expected the deleted rows' pages to be free, got %+v", header)
+	}
+
+	// The free pages are reused after reopening, instead of growing the file
+	db, err = rashdb.Open(path, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertAll(db)
+	var bar testBar
+	err = db.Get("Bars", fmt.Sprint(numRows-1), &bar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bar.Raw) != 300 || bar.Raw[0] != byte((numRows-1)%256) {
+		t.Fatalf("Unexpected row %+v", bar)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reused := readHeader()
+	if reused.NumPages != header.NumPages {
+		t.Fatalf("Expected the DB to stay at %d pages, got %d", header.NumPages, reused.NumPages)
+	}
+	if reused.FreelistCount >= header.FreelistCount {
+		t.Fatalf("Expected free pages to be used, %d pages were free and %d still are", header.FreelistCount, reused.FreelistCount)
+	}
+}
+
+func TestUpdateDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := rashdb.Open(path, &rashdb.DBOpenOptions{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateTable("Bars", testBar{}, "Symbol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const numRows = 500
+	for i := 0; i < numRows; i++ {
+		_, err = db.Insert("Bars", testBar{Symbol: fmt.Sprint(i), Timestamp: uint64(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.UpdateRow("Bars", testBar{Symbol: "missing"})
+	if err != rashdb.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	err = db.Delete("Bars", "missing")
+	if err != rashdb.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	// Rows grow past a page with overflow, and shrink back
+	for i := 0; i < numRows; i += 3 {
+		err = db.UpdateRow("Bars", testBar{Symbol: fmt.Sprint(i), Timestamp: uint64(i) * 10, Raw: bytes.Repeat([]byte{1}, 2000)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < numRows; i += 6 {
+		err = db.Upsert("Bars", testBar{Symbol: fmt.Sprint(i), Timestamp: uint64(i) * 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < numRows; i += 3 {
+		err = db.Delete("Bars", fmt.Sprint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Upsert("Bars", testBar{Symbol: "new", Timestamp: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = rashdb.Open(path, &rashdb.DBOpenOptions{MustExist: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < numRows; i++ {
+		var bar testBar
+		err = db.Get("Bars", fmt.Sprint(i), &bar)
+		switch {
+		case i%3 == 1:
+			if err != rashdb.ErrKeyNotFound {
+				t.Fatalf("%d: expected ErrKeyNotFound, got %v", i, err)
+			}
+			continue
+		case err != nil:
+			t.Fatalf("%d: %v", i, err)
+		}
+		timestamp, rawLen := uint64(i), 0
+		if i%3 == 0 {
+			timestamp *= 10
+			if i%6 != 0 {
+				rawLen = 2000
+			}
+		}
+		if bar.Timestamp != timestamp || len(bar.Raw) != rawLen {
+			t.Fatalf("%d: unexpected row %+v", i, bar)
+		}
+	}
+	var bar testBar
+	err = db.Get("Bars", "new", &bar)
+	if err != nil || bar.Timestamp != 1 {
+		t.Fatalf("Expected the upserted row, got %+v, %v", bar, err)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	symbols := []string{"AAPL", "SPY", "TSLA"}
+	err := db.Update(func(tx *rashdb.Tx) error {
+		err := tx.CreateTable("Bars", testBar{}, "Symbol", "Timestamp")
+		if err != nil {
+			return err
+		}
+		for _, symbol := range symbols {
+			for ts := uint64(0); ts < 300; ts++ {
+				_, err = tx.Insert("Bars", testBar{Symbol: symbol, Timestamp: ts, Open: float64(ts)})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.View(func(tx *rashdb.Tx) error {
+		c, err := tx.Cursor("Bars")
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		// All the bars for SPY between 100 and 200
+		var bar testBar
+		expected := uint64(100)
+		ok, err := c.Seek(rashdb.Key{"SPY", uint64(100)})
+		for ; ok; ok, err = c.Next() {
+			err = c.Scan(&bar)
+			if err != nil {
+				return err
+			}
+			if bar.Symbol != "SPY" || bar.Timestamp > 200 {
+				break
+			}
+			if bar.Timestamp != expected || bar.Open != float64(expected) {
+				return fmt.Errorf("Expected the bar at %d, got %+v", expected, bar)
+			}
+			expected++
+		}
+		if err != nil {
+			return err
+		}
+		if expected != 201 {
+			return fmt.Errorf("Expected to stop after 200, stopped at %d", expected)
+		}
+
+		// A prefix of the key seeks to the first row that starts with it
+		ok, err = c.Seek(rashdb.Key{"TSLA"})
+		if err != nil || !ok {
+			return fmt.Errorf("Expected to find TSLA, %v", err)
+		}
+		ok, err = c.Prev()
+		if err != nil || !ok {
+			return fmt.Errorf("Expected a row before TSLA, %v", err)
+		}
+		err = c.Scan(&bar)
+		if err != nil {
+			return err
+		}
+		if bar.Symbol != "SPY" || bar.Timestamp != 299 {
+			return fmt.Errorf("Expected the last SPY bar, got %+v", bar)
+		}
+
+		// The whole table, backwards
+		n := 0
+		for ok, err = c.Last(); ok; ok, err = c.Prev() {
+			n++
+		}
+		if err != nil {
+			return err
+		}
+		if n != len(symbols)*300 {
+			return fmt.Errorf("Expected %d rows, got %d", len(symbols)*300, n)
+		}
+		if err = c.Scan(&bar); err != rashdb.ErrCursorNotOnRow {
+			return fmt.Errorf("Expected ErrCursorNotOnRow, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := rashdb.Open(path, &rashdb.DBOpenOptions{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateTable("Bars", testBar{}, "Symbol", "Timestamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every Close price is shared by two bars. Some rows are there before the index, the rest are added after
+	const numRows = 400
+	insert := func(from, to int) {
+		for i := from; i < to; i++ {
+			_, err := db.Insert("Bars", testBar{Symbol: fmt.Sprint(i % 7), Timestamp: uint64(i), Close: float64(i / 2)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	insert(0, numRows/2)
+	err = db.CreateIndex("Bars", "ByClose", "Close")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(numRows/2, numRows)
+
+	if err = db.CreateIndex("Bars", "ByClose", "Open"); err != rashdb.ErrIndexExists {
+		t.Fatalf("Expected ErrIndexExists, got %v", err)
+	}
+	if err = db.CreateIndex("Bars", "Bars", "Open"); err != rashdb.ErrIndexExists {
+		t.Fatalf("Expected ErrIndexExists, got %v", err)
+	}
+	if err = db.CreateTable("ByClose", testBar{}, "Symbol"); err != rashdb.ErrTableExists {
+		t.Fatalf("Expected ErrTableExists, got %v", err)
+	}
+	if err = db.CreateIndex("Bars", "ByTags", "Tags"); err == nil {
+		t.Fatal("Expected an error for an index on a JSON column")
+	}
+	if err = db.CreateIndex("Bars", "ByNothing", "Nothing"); err == nil {
+		t.Fatal("Expected an error for an index on a missing column")
+	}
+
+	// Moving rows around keeps the index up to date
+	for i := 0; i < numRows; i += 4 {
+		err = db.UpdateRow("Bars", testBar{Symbol: fmt.Sprint(i % 7), Timestamp: uint64(i), Close: float64(i/2) + 0.5})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < numRows; i += 4 {
+		err = db.Delete("Bars", rashdb.Key{fmt.Sprint(i % 7), uint64(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Upsert("Bars", testBar{Symbol: "new", Timestamp: 1, Close: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = rashdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// The rows of each price, in index order
+	expected := make([]testBar, 0)
+	for close := 0; close < numRows/2; close++ {
+		for _, i := range []int{2 * close, 2*close + 1} {
+			switch i % 4 {
+			case 0:
+				continue
+			case 1:
+				// deleted
+				continue
+			}
+			expected = append(expected, testBar{Symbol: fmt.Sprint(i % 7), Timestamp: uint64(i), Close: float64(close)})
+		}
+		// The updated row with this price and a half
+		i := 2 * close
+		if i%4 == 0 {
+			expected = append(expected, testBar{Symbol: fmt.Sprint(i % 7), Timestamp: uint64(i), Close: float64(close) + 0.5})
+		}
+	}
+	expected = append(expected, testBar{Symbol: "new", Timestamp: 1, Close: 1000})
+	// Rows with the same price are in primary key order
+	sort.Slice(expected, func(i, j int) bool {
+		a, b := expected[i], expected[j]
+		if a.Close != b.Close {
+			return a.Close < b.Close
+		}
+		if a.Symbol != b.Symbol {
+			return a.Symbol < b.Symbol
+		}
+		return a.Timestamp < b.Timestamp
+	})
+
+	err = db.View(func(tx *rashdb.Tx) error {
+		c, err := tx.IndexCursor("Bars", "ByClose")
+		if err != nil {
+			return err
+		}
+		n := 0
+		var ok bool
+		for ok, err = c.First(); ok; ok, err = c.Next() {
+			var bar testBar
+			err = c.Scan(&bar)
+			if err != nil {
+				return err
+			}
+			if n >= len(expected) || !reflect.DeepEqual(bar, expected[n]) {
+				return fmt.Errorf("Row %d: got %+v", n, bar)
+			}
+			n++
+		}
+		if err != nil {
+			return err
+		}
+		if n != len(expected) {
+			return fmt.Errorf("Expected %d rows in the index, got %d", len(expected), n)
+		}
+
+		// A range of prices
+		ok, err = c.Seek(10.0)
+		if err != nil || !ok {
+			return fmt.Errorf("Expected a row at 10, %v", err)
+		}
+		var bar testBar
+		err = c.Scan(&bar)
+		if err != nil {
+			return err
+		}
+		if bar.Close != 10.5 {
+			return fmt.Errorf("Expected the first row at 10 or more to be at 10.5, got %+v", bar)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bar testBar
+	err = db.GetByIndex("Bars", "ByClose", 7.0, &bar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both 14 and 15 are at 7, but 14 has the smaller primary key
+	if bar.Timestamp != 14 {
+		t.Fatalf("Expected the row at 14, got %+v", bar)
+	}
+	err = db.GetByIndex("Bars", "ByClose", 6.0, &bar)
+	if err != rashdb.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	err = db.GetByIndex("Bars", "ByOpen", 6.0, &bar)
+	if err != rashdb.ErrUnknownIndexName {
+		t.Fatalf("Expected ErrUnknownIndexName, got %v", err)
+	}
+}
+
+type testUser struct {
+	ID    int64
+	Email string
+	Name  string
+}
+
+func TestUniqueConstraint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := rashdb.Open(path, &rashdb.DBOpenOptions{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateTableWithOptions("Users", testUser{}, &rashdb.TableOptions{
+		PrimaryKey: []string{"ID"},
+		Unique:     []string{"Email"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		_, err = db.Insert("Users", testUser{ID: int64(i), Email: fmt.Sprintf("user%d@example.com", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkConflict := func(err error, email string) {
+		t.Helper()
+		var uniqueErr *rashdb.UniqueConstraintError
+		if !errors.As(err, &uniqueErr) || !errors.Is(err, rashdb.ErrUniqueConstraint) {
+			t.Fatalf("Expected a UniqueConstraintError, got %v", err)
+		}
+		if uniqueErr.Table != "Users" || uniqueErr.Column != "Email" || uniqueErr.Value != email {
+			t.Fatalf("Unexpected error %+v", uniqueErr)
+		}
+	}
+
+	_, err = db.Insert("Users", testUser{ID: 100, Email: "user5@example.com"})
+	checkConflict(err, "user5@example.com")
+	// A row keeps its own value
+	err = db.UpdateRow("Users", testUser{ID: 5, Email: "user5@example.com", Name: "Five"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UpdateRow("Users", testUser{ID: 5, Email: "user6@example.com"})
+	checkConflict(err, "user6@example.com")
+	err = db.Upsert("Users", testUser{ID: 7, Email: "user6@example.com"})
+	checkConflict(err, "user6@example.com")
+	// A row that doesn't exist can't be updated, whatever its values are
+	err = db.UpdateRow("Users", testUser{ID: 1000, Email: "user6@example.com"})
+	if !errors.Is(err, rashdb.ErrKeyNotFound) {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	var user testUser
+	err = db.Get("Users", int64(5), &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "user5@example.com" || user.Name != "Five" {
+		t.Fatalf("Expected the failed update to leave the row as it was, got %+v", user)
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The constraint is part of the schema
+	db, err = rashdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *rashdb.Tx) error {
+		_, err := tx.Insert("Users", testUser{ID: 100, Email: "user9@example.com"})
+		checkConflict(err, "user9@example.com")
+		// Once the other row is gone, its value can be used again
+		err = tx.Delete("Users", int64(9))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Insert("Users", testUser{ID: 100, Email: "user9@example.com"})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.CreateTableWithOptions("Bad", testUser{}, &rashdb.TableOptions{
+		PrimaryKey: []string{"ID"},
+		Unique:     []string{"Missing"},
+	})
+	if err == nil {
+		t.Fatal("Expected an error for a unique column that doesn't exist")
+	}
+}
+
+type testTagged struct {
+	ID    int64    `rashdb:"id,pk"`
+	Email string   `rashdb:"email,unique"`
+	City  string   `rashdb:"city,index"`
+	Bio   string   `rashdb:",omitempty"`
+	Tags  []string `rashdb:"tags,notnull"`
+	// Only used in memory
+	Cache   []byte `rashdb:"-"`
+	private int
+}
+
+func TestStructTags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := rashdb.Open(path, &rashdb.DBOpenOptions{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The primary key comes from the tags
+	err = db.CreateTable("Tagged", testTagged{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cities := []string{"Oslo", "Lima", "Pune"}
+	for i := 0; i < 30; i++ {
+		_, err = db.Insert("Tagged", testTagged{
+			ID:    int64(i),
+			Email: fmt.Sprintf("user%d@example.com", i),
+			City:  cities[i%len(cities)],
+			Tags:  []string{},
+			Cache: []byte("not stored"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.Insert("Tagged", testTagged{ID: 100, Email: "user3@example.com", Tags: []string{}})
+	var uniqueErr *rashdb.UniqueConstraintError
+	if !errors.As(err, &uniqueErr) || uniqueErr.Column != "email" {
+		t.Fatalf("Expected a unique constraint error on email, got %v", err)
+	}
+	_, err = db.Insert("Tagged", testTagged{ID: 100, Email: "user100@example.com"})
+	var notNullErr *rashdb.NotNullConstraintError
+	if !errors.As(err, &notNullErr) || !errors.Is(err, rashdb.ErrNotNullConstraint) || notNullErr.Column != "tags" {
+		t.Fatalf("Expected a not null constraint error on tags, got %v", err)
+	}
+	err = db.UpdateRow("Tagged", testTagged{ID: 4, Email: "user4@example.com", City: "Lima", Bio: "Four", Tags: []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = rashdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	row := testTagged{Cache: []byte("kept")}
+	err = db.Get("Tagged", int64(4), &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := testTagged{ID: 4, Email: "user4@example.com", City: "Lima", Bio: "Four", Tags: []string{"a"}, Cache: []byte("kept")}
+	if !reflect.DeepEqual(row, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, row)
+	}
+	// The column gets its own index, and the rows come back in primary key order
+	err = db.GetByIndex("Tagged", "rashdb_index_Tagged_city", "Pune", &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.ID != 2 || row.Bio != "" {
+		t.Fatalf("Expected the first row in Pune, got %+v", row)
+	}
+	err = db.GetByIndex("Tagged", "rashdb_unique_Tagged_email", "user7@example.com", &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.ID != 7 {
+		t.Fatalf("Expected row 7, got %+v", row)
+	}
+
+	type badOption struct {
+		ID int64 `rashdb:"id,pk,primary"`
+	}
+	type duplicateName struct {
+		ID   int64 `rashdb:"id,pk"`
+		Name int64 `rashdb:"id"`
+	}
+	for _, tableType := range []interface{}{badOption{}, duplicateName{}} {
+		err = db.CreateTable("Bad", tableType)
+		if err == nil {
+			t.Fatalf("Expected an error for the tags of %T", tableType)
+		}
+	}
+	err = db.CreateTable("Bad", testTagged{}, "email")
+	if !errors.Is(err, rashdb.ErrPrimaryKeyTwice) {
+		t.Fatalf("Expected ErrPrimaryKeyTwice, got %v", err)
+	}
+}
+
+type testNullable struct {
+	ID     int64 `rashdb:",pk"`
+	Name   *string
+	Age    *int64
+	Nick   sql.NullString `rashdb:",unique"`
+	Score  sql.NullFloat64
+	Avatar []byte
+	Code   string `rashdb:",notnull"`
+}
+
+// The same table, without some of its columns
+type testNullableShort struct {
+	ID   int64 `rashdb:",pk"`
+	Code string
+}
+
+func TestNullValues(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	err := db.CreateTable("Nullable", testNullable{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, age := "Ada", int64(36)
+	rows := []testNullable{
+		{ID: 1, Code: "a"},
+		{ID: 2, Code: "b", Name: &name, Age: &age, Avatar: []byte{1, 2},
+			Nick: sql.NullString{String: "ada", Valid: true}, Score: sql.NullFloat64{Float64: 1.5, Valid: true}},
+		// More than one row can be NULL in a unique column
+		{ID: 3, Code: "c"},
+	}
+	for _, row := range rows {
+		_, err = db.Insert("Nullable", row)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.Insert("Nullable", testNullableShort{ID: 4, Code: "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows = append(rows, testNullable{ID: 4, Code: "d"})
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range rows {
+		// Start from a row with every field set, to check that NULL clears them
+		other := "other"
+		row := testNullable{Name: &other, Age: &age, Avatar: []byte{3}, Nick: sql.NullString{String: "x", Valid: true}}
+		err = db.Get("Nullable", expected.ID, &row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(row, expected) {
+			t.Fatalf("Expected %+v, got %+v", expected, row)
+		}
+	}
+
+	_, err = db.Insert("Nullable", testNullable{ID: 5, Nick: sql.NullString{String: "ada", Valid: true}, Code: "e"})
+	if !errors.Is(err, rashdb.ErrUniqueConstraint) {
+		t.Fatalf("Expected a unique constraint error, got %v", err)
+	}
+	_, err = db.Insert("Nullable", testNullableShort{ID: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type noCode struct {
+		ID int64 `rashdb:",pk"`
+	}
+	_, err = db.Insert("Nullable", noCode{ID: 6})
+	var notNullErr *rashdb.NotNullConstraintError
+	if !errors.As(err, &notNullErr) || notNullErr.Column != "Code" {
+		t.Fatalf("Expected a not null constraint error on Code, got %v", err)
+	}
+
+	// Primary keys can't be NULL
+	type pointerKey struct {
+		ID *int64 `rashdb:",pk"`
+	}
+	err = db.CreateTable("PointerKey", pointerKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Insert("PointerKey", pointerKey{})
+	if !errors.Is(err, rashdb.ErrNotNullConstraint) {
+		t.Fatalf("Expected a not null constraint error, got %v", err)
+	}
+	_, err = db.Insert("PointerKey", pointerKey{ID: &age})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key pointerKey
+	err = db.Get("PointerKey", age, &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID == nil || *key.ID != age {
+		t.Fatalf("Expected the key %d, got %v", age, key.ID)
+	}
+}
+
+func TestTypeCheck(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	type numbers struct {
+		ID    uint64 `rashdb:",pk"`
+		Count int32
+		Ratio float64
+		Name  string
+		Raw   []byte
+		Tags  []string
+		Attrs map[string]int
+	}
+	err := db.CreateTable("Numbers", numbers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Integers go into real columns, and uint64 values that overflow int64 can still be stored
+	type converted struct {
+		ID    uint64 `rashdb:",pk"`
+		Count uint8
+		Ratio int
+	}
+	_, err = db.Insert("Numbers", converted{ID: math.MaxUint64, Count: 200, Ratio: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var row numbers
+	err = db.Get("Numbers", uint64(math.MaxUint64), &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.ID != math.MaxUint64 || row.Count != 200 || row.Ratio != 3 {
+		t.Fatalf("Unexpected row %+v", row)
+	}
+
+	checkTypeError := func(val interface{}, column string, expected app.DataType, actual reflect.Type) {
+		t.Helper()
+		_, err := db.Insert("Numbers", val)
+		var typeErr *rashdb.ColumnTypeError
+		if !errors.As(err, &typeErr) || !errors.Is(err, rashdb.ErrColumnType) {
+			t.Fatalf("Expected a ColumnTypeError, got %v", err)
+		}
+		if typeErr.Table != "Numbers" || typeErr.Column != column || typeErr.Expected != expected || typeErr.Actual != actual {
+			t.Fatalf("Unexpected error %+v", typeErr)
+		}
+	}
+	type badInt struct {
+		ID    uint64 `rashdb:",pk"`
+		Count float64
+	}
+	checkTypeError(badInt{ID: 1, Count: 1.5}, "Count", app.DBInt, reflect.TypeOf(float64(0)))
+	type badKey struct {
+		ID string `rashdb:",pk"`
+	}
+	checkTypeError(badKey{ID: "one"}, "ID", app.DBInt, reflect.TypeOf(""))
+	type badBlob struct {
+		ID  uint64 `rashdb:",pk"`
+		Raw []string
+	}
+	checkTypeError(badBlob{ID: 1, Raw: []string{"a"}}, "Raw", app.DBBlob, reflect.TypeOf([]string{}))
+	type badJSON struct {
+		ID    uint64 `rashdb:",pk"`
+		Tags  map[string]int
+		Attrs []int
+	}
+	checkTypeError(badJSON{ID: 1, Tags: map[string]int{}}, "Tags", app.DBJsonArr, reflect.TypeOf(map[string]int{}))
+	checkTypeError(badJSON{ID: 1, Attrs: []int{1}}, "Attrs", app.DBJsonData, reflect.TypeOf([]int{}))
+	// NULL fits any column
+	type nullName struct {
+		ID   uint64 `rashdb:",pk"`
+		Name *int
+	}
+	_, err = db.Insert("Numbers", nullName{ID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Maps are stored as JSON objects, so their keys have to be strings
+	type intKeys struct {
+		ID  uint64 `rashdb:",pk"`
+		Tag map[int]string
+	}
+	err = db.CreateTable("IntKeys", intKeys{})
+	if !errors.Is(err, rashdb.ErrInvalidTableValue) {
+		t.Fatalf("Expected ErrInvalidTableValue, got %v", err)
+	}
+	err = db.AddColumn("Numbers", "Tag", map[int]string{})
+	if !errors.Is(err, rashdb.ErrInvalidTableValue) {
+		t.Fatalf("Expected ErrInvalidTableValue, got %v", err)
+	}
+}
+
+func TestJSONColumns(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	type document struct {
+		ID     string `rashdb:",pk"`
+		Counts []int64
+		Limits map[string]uint64
+		Nested map[string][]map[string]string
+	}
+	err := db.CreateTable("Documents", document{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// These numbers don't survive a round trip through float64, only through encoding/json
+	doc := document{
+		ID:     "a",
+		Counts: []int64{math.MaxInt64, math.MinInt64, 0},
+		Limits: map[string]uint64{"max": math.MaxUint64},
+		Nested: map[string][]map[string]string{"x": {{"y": "z"}}},
+	}
+	_, err = db.Insert("Documents", doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got document
+	err = db.Get("Documents", "a", &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, doc) {
+		t.Fatalf("Expected %+v, got %+v", doc, got)
+	}
+}
+
+func TestCursorColumns(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	err := db.Update(func(tx *rashdb.Tx) error {
+		err := tx.CreateTable("Bars", testBar{}, "Symbol", "Timestamp")
+		if err != nil {
+			return err
+		}
+		err = tx.CreateIndex("Bars", "ByClose", "Close")
+		if err != nil {
+			return err
+		}
+		for ts := uint64(0); ts < 100; ts++ {
+			bar := testBar{Symbol: "SPY", Timestamp: ts, Open: float64(ts), Close: float64(100 - ts), Tags: []string{"x"}}
+			_, err = tx.Insert("Bars", bar)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.View(func(tx *rashdb.Tx) error {
+		c, err := tx.Cursor("Bars")
+		if err != nil {
+			return err
+		}
+		err = c.Columns("Close", "Timestamp")
+		if err != nil {
+			return err
+		}
+		n := 0
+		for ok, err := c.First(); ok; ok, err = c.Next() {
+			if err != nil {
+				return err
+			}
+			// Only the projected fields are filled in
+			bar := testBar{Open: -1}
+			err = c.Scan(&bar)
+			if err != nil {
+				return err
+			}
+			expected := testBar{Timestamp: uint64(n), Close: float64(100 - n), Open: -1}
+			if !reflect.DeepEqual(bar, expected) {
+				return fmt.Errorf("Expected %+v, got %+v", expected, bar)
+			}
+			n++
+		}
+		if n != 100 {
+			return fmt.Errorf("Expected 100 rows, got %d", n)
+		}
+		// A struct with just the projected columns works too
+		var small struct {
+			Timestamp uint64
+			Close     float64
+		}
+		_, err = c.Last()
+		if err != nil {
+			return err
+		}
+		err = c.Scan(&small)
+		if err != nil {
+			return err
+		}
+		if small.Timestamp != 99 || small.Close != 1 {
+			return fmt.Errorf("Unexpected row %+v", small)
+		}
+
+		// Back to every column
+		err = c.Columns()
+		if err != nil {
+			return err
+		}
+		var bar testBar
+		err = c.Scan(&bar)
+		if err != nil {
+			return err
+		}
+		if bar.Open != 99 || len(bar.Tags) != 1 {
+			return fmt.Errorf("Expected every column, got %+v", bar)
+		}
+		for _, names := range [][]string{{"Missing"}, {"Close", "Close"}} {
+			if err = c.Columns(names...); err == nil {
+				return fmt.Errorf("Expected an error for the columns %v", names)
+			}
+		}
+
+		// The index holds Close and the primary key, so both cursors agree
+		for _, cols := range [][]string{{"Close", "Symbol"}, {"Open", "Close"}} {
+			c, err = tx.IndexCursor("Bars", "ByClose")
+			if err != nil {
+				return err
+			}
+			err = c.Columns(cols...)
+			if err != nil {
+				return err
+			}
+			ok, err := c.First()
+			if err != nil || !ok {
+				return fmt.Errorf("Expected a row, %v", err)
+			}
+			bar = testBar{}
+			err = c.Scan(&bar)
+			if err != nil {
+				return err
+			}
+			if bar.Close != 1 || bar.Timestamp != 0 || (cols[0] == "Open") != (bar.Open == 99) || (cols[1] == "Symbol") != (bar.Symbol == "SPY") {
+				return fmt.Errorf("Unexpected row %+v for the columns %v", bar, cols)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAlterTable(t *testing.T) {
+	type userV1 struct {
+		ID   int64 `rashdb:",pk"`
+		Name string
+		Age  int64
+	}
+	type userV2 struct {
+		ID    int64 `rashdb:",pk"`
+		Name  string
+		Age   int64
+		Email string
+	}
+	// Name is renamed, and Age is dropped
+	type userV3 struct {
+		ID       int64 `rashdb:",pk"`
+		FullName string
+		Email    string
+	}
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := rashdb.Open(path, &rashdb.DBOpenOptions{PageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateTable("Users", userV1{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		_, err = db.Insert("Users", userV1{ID: int64(i), Name: fmt.Sprintf("user%d", i), Age: int64(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.Insert("Users", userV2{ID: 100, Email: "a@example.com"})
+	if err == nil {
+		t.Fatal("Expected an error for a field that isn't a column")
+	}
+	err = db.AddColumn("Users", "Email", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.AddColumn("Users", "Email", ""); !errors.Is(err, rashdb.ErrColumnExists) {
+		t.Fatalf("Expected ErrColumnExists, got %v", err)
+	}
+	_, err = db.Insert("Users", userV2{ID: 100, Name: "new", Email: "new@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Old rows read NULL for the new column
+	v2 := userV2{Email: "not cleared"}
+	err = db.Get("Users", int64(5), &v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2 != (userV2{ID: 5, Name: "user5", Age: 5}) {
+		t.Fatalf("Unexpected row %+v", v2)
+	}
+	err = db.CreateIndex("Users", "ByEmail", "Email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.DropColumn("Users", "Email"); !errors.Is(err, rashdb.ErrColumnIndexed) {
+		t.Fatalf("Expected ErrColumnIndexed, got %v", err)
+	}
+	if err = db.DropColumn("Users", "ID"); err == nil {
+		t.Fatal("Expected an error for dropping a primary key column")
+	}
+	err = db.DropColumn("Users", "Age")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RenameColumn("Users", "Name", "FullName")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.RenameColumn("Users", "FullName", "Email"); !errors.Is(err, rashdb.ErrColumnExists) {
+		t.Fatalf("Expected ErrColumnExists, got %v", err)
+	}
+	err = db.Get("Users", int64(5), &v2)
+	if err == nil {
+		t.Fatal("Expected an error for reading dropped and renamed columns")
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = rashdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkRows := func() {
+		t.Helper()
+		var v3 userV3
+		err = db.Get("Users", int64(7), &v3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v3 != (userV3{ID: 7, FullName: "user7"}) {
+			t.Fatalf("Unexpected row %+v", v3)
+		}
+		// The index still works after the columns around it changed
+		err = db.GetByIndex("Users", "ByEmail", "new@example.com", &v3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v3 != (userV3{ID: 100, FullName: "new", Email: "new@example.com"}) {
+			t.Fatalf("Unexpected row %+v", v3)
+		}
+	}
+	checkRows()
+	// Age can come back, without the values of the dropped column
+	err = db.AddColumn("Users", "Age", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type userV4 struct {
+		ID       int64 `rashdb:",pk"`
+		FullName string
+		Email    string
+		Age      *string
+	}
+	var v4 userV4
+	err = db.Get("Users", int64(9), &v4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v4.Age != nil || v4.FullName != "user9" {
+		t.Fatalf("Unexpected row %+v", v4)
+	}
+	err = db.DropColumn("Users", "Age")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.CompactTable("Users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRows()
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Compacting removes the dropped columns from the schema
+	err = db.View(func(tx *rashdb.Tx) error {
+		c, err := tx.Cursor("Users")
+		if err != nil {
+			return err
+		}
+		if err = c.Columns("Age"); err == nil {
+			return errors.New("Expected Age to be gone")
+		}
+		return c.Columns("FullName", "Email")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Renaming an indexed column renames it in the index too
+	err = db.RenameColumn("Users", "Email", "Mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v5 struct {
+		ID       int64 `rashdb:",pk"`
+		FullName string
+		Mail     string
+	}
+	err = db.GetByIndex("Users", "ByEmail", "new@example.com", &v5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v5.ID != 100 || v5.Mail != "new@example.com" {
+		t.Fatalf("Unexpected row %+v", v5)
+	}
+	_, err = db.Insert("Users", struct {
+		ID   int64 `rashdb:",pk"`
+		Mail string
+	}{ID: 101, Mail: "other@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.GetByIndex("Users", "ByEmail", "other@example.com", &v5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v5.ID != 101 {
+		t.Fatalf("Expected the new row, got %+v", v5)
+	}
+}
+
+func TestDropRenameTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := rashdb.DBOpenOptions{PageSize: 1024}
+	db, err := rashdb.Open(path, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const numRows = 200
+	fill := func(db *rashdb.DB) {
+		t.Helper()
+		err := db.Update(func(tx *rashdb.Tx) error {
+			err := tx.CreateTable("Bars", testBar{}, "Symbol")
+			if err != nil {
+				return err
+			}
+			for i := 0; i < numRows; i++ {
+				// Big enough to spill into overflow pages
+				_, err = tx.Insert("Bars", testBar{Symbol: fmt.Sprint(i), Raw: bytes.Repeat([]byte{1}, 2000)})
+				if err != nil {
+					return err
+				}
+			}
+			return tx.CreateIndex("Bars", "BarsByOpen", "Open")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fill(db)
+	err = db.Update(func(tx *rashdb.Tx) error {
+		err := tx.CreateTable("Tagged", testTagged{})
+		if err != nil {
+			return err
+		}
+		_, err = tx.Insert("Tagged", testTagged{ID: 1, Email: "a@example.com", City: "Oslo", Tags: []string{}})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A rename is undone with the rest of its transaction
+	errRollback := errors.New("rollback")
+	err = db.Update(func(tx *rashdb.Tx) error {
+		err := tx.RenameTable("Tagged", "People")
+		if err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("Expected the rollback error, got %v", err)
+	}
+	var row testTagged
+	err = db.Get("Tagged", int64(1), &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.RenameTable("Tagged", "Bars"); !errors.Is(err, rashdb.ErrTableExists) {
+		t.Fatalf("Expected ErrTableExists, got %v", err)
+	}
+	err = db.RenameTable("Tagged", "People")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Get("Tagged", int64(1), &row)
+	if !errors.Is(err, rashdb.ErrUnknownTableName) {
+		t.Fatalf("Expected ErrUnknownTableName, got %v", err)
+	}
+	err = db.GetByIndex("People", "rashdb_unique_People_email", "a@example.com", &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.City != "Oslo" {
+		t.Fatalf("Unexpected row %+v", row)
+	}
+	// The old name, and the names of its indexes, can be used again
+	err = db.CreateTable("Tagged", testTagged{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.DropTable("Bars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bar testBar
+	err = db.Get("Bars", "1", &bar)
+	if !errors.Is(err, rashdb.ErrUnknownTableName) {
+		t.Fatalf("Expected ErrUnknownTableName, got %v", err)
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := readTestHeader(t, path)
+	if header.FreelistCount < numRows {
+		t.Fatalf("Expected the pages of the dropped table to be free, got %+v", header)
+	}
+
+	db, err = rashdb.Open(path, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.GetByIndex("People", "rashdb_index_People_city", "Oslo", &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx *rashdb.Tx) error {
+		_, err := tx.IndexCursor("Bars", "BarsByOpen")
+		return err
+	})
+	if !errors.Is(err, rashdb.ErrUnknownTableName) {
+		t.Fatalf("Expected the dropped table to stay dropped, got %v", err)
+	}
+	// The free pages are reused
+	fill(db)
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after := readTestHeader(t, path); after.NumPages > header.NumPages {
+		t.Fatalf("Expected the file not to grow past %d pages, got %d", header.NumPages, after.NumPages)
+	}
+}
+
+type testNote struct {
+	ID   int64 `rashdb:"id,autoincrement"`
+	Text string
+}
+
+type testEvent struct {
+	Name string
+	At   int64
+}
+
+func TestAutoIncrement(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := rashdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateTable("Notes", testNote{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := func(val interface{}, expected int64) {
+		t.Helper()
+		id, err := db.Insert("Notes", val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != expected {
+			t.Fatalf("Expected ID %d, got %d", expected, id)
+		}
+	}
+	note := testNote{Text: "first"}
+	insert(&note, 1)
+	if note.ID != 1 {
+		t.Fatalf("Expected the ID to be written back, got %+v", note)
+	}
+	insert(testNote{Text: "second"}, 2)
+	// Explicit IDs are kept, and move the sequence past them
+	insert(testNote{ID: 10, Text: "tenth"}, 10)
+	insert(testNote{Text: "eleventh"}, 11)
+	if _, err = db.Insert("Notes", testNote{ID: 10}); !errors.Is(err, rashdb.ErrDuplicateKey) {
+		t.Fatalf("Expected ErrDuplicateKey, got %v", err)
+	}
+	// IDs aren't reused
+	err = db.Delete("Notes", int64(11))
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(testNote{Text: "twelfth"}, 12)
+	// Updates need the ID
+	if err = db.UpdateRow("Notes", testNote{Text: "none"}); !errors.Is(err, rashdb.ErrInsertNoPrimaryKey) {
+		t.Fatalf("Expected ErrInsertNoPrimaryKey, got %v", err)
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// IDs taken in a transaction that is rolled back are given out again
+	errRollback := errors.New("rollback")
+	err = db.Update(func(tx *rashdb.Tx) error {
+		id, err := tx.Insert("Notes", testNote{Text: "rolled back"})
+		if err != nil {
+			return err
+		}
+		if id != 13 {
+			t.Errorf("Expected ID 13, got %d", id)
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("Expected the rollback error, got %v", err)
+	}
+
+	// A table without a primary key is keyed by its rowid
+	err = db.CreateTable("Events", testEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		id, err := db.Insert("Events", testEvent{Name: fmt.Sprint("event", i), At: int64(i * 100)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != int64(i) {
+			t.Fatalf("Expected rowid %d, got %d", i, id)
+		}
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sequences are stored with the tables
+	db, err = rashdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	insert(testNote{Text: "thirteenth"}, 13)
+	id, err := db.Insert("Events", &testEvent{Name: "event4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 4 {
+		t.Fatalf("Expected rowid 4, got %d", id)
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event testEvent
+	err = db.Get("Events", int64(2), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Name != "event2" || event.At != 200 {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+	err = db.View(func(tx *rashdb.Tx) error {
+		c, err := tx.Cursor("Events")
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		var ids []string
+		err = c.Columns(rashdb.RowIDColumn, "Name")
+		if err != nil {
+			return err
+		}
+		for ok, err := c.First(); ok; ok, err = c.Next() {
+			if err != nil {
+				return err
+			}
+			var event testEvent
+			err = c.Scan(&event)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, event.Name)
+		}
+		if !reflect.DeepEqual(ids, []string{"event1", "event2", "event3", "event4"}) {
+			t.Errorf("Expected the events in rowid order, got %v", ids)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Small ID fields are checked before the row goes in
+	type smallID struct {
+		ID   *int8 `rashdb:"id,autoincrement"`
+		Name string
+	}
+	err = db.CreateTable("Small", smallID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := smallID{Name: "a"}
+	_, err = db.Insert("Small", &small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if small.ID == nil || *small.ID != 1 {
+		t.Fatalf("Expected the ID to be written back, got %v", small.ID)
+	}
+	// A pointer to 0 is unset, like a nil pointer
+	zero := smallID{ID: new(int8), Name: "zero"}
+	id, err = db.Insert("Small", &zero)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 2 || *zero.ID != 2 {
+		t.Fatalf("Expected ID 2, got %d and %d", id, *zero.ID)
+	}
+	maxID := int8(math.MaxInt8)
+	_, err = db.Insert("Small", smallID{ID: &maxID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Insert("Small", smallID{Name: "overflow"}); err == nil {
+		t.Fatal("Expected the next ID not to fit in an int8")
+	}
+
+	// Autoincrementing keys have to be the whole primary key, and an integer
+	type stringID struct {
+		ID string `rashdb:"id,autoincrement"`
+	}
+	type hiddenRowID struct {
+		RowID int64 `rashdb:"rowid"`
+	}
+	bad := []struct {
+		tableType interface{}
+		options   rashdb.TableOptions
+	}{
+		{stringID{}, rashdb.TableOptions{}},
+		{testEvent{}, rashdb.TableOptions{PrimaryKey: []string{"Name", "At"}, AutoIncrement: "At"}},
+		{testEvent{}, rashdb.TableOptions{PrimaryKey: []string{"Name"}, AutoIncrement: "At"}},
+		{testEvent{}, rashdb.TableOptions{AutoIncrement: "At"}},
+		{hiddenRowID{}, rashdb.TableOptions{}},
+	}
+	for i, tc := range bad {
+		err = db.CreateTableWithOptions(fmt.Sprint("Bad", i), tc.tableType, &tc.options)
+		if err == nil {
+			t.Fatalf("Expected an error creating table %d", i)
+		}
+	}
+}
+
+type testFlag struct {
+	Active   bool   `rashdb:"active,pk"`
+	Name     string `rashdb:"name,pk"`
+	Archived bool   `rashdb:"archived,index"`
+}
+
+func TestBoolKeys(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	rows := []testFlag{
+		{Active: true, Name: "a", Archived: false},
+		{Active: false, Name: "b", Archived: true},
+		{Active: true, Name: "c", Archived: true},
+	}
+	err := db.CreateTable("Flags", testFlag{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		_, err = db.Insert("Flags", row)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		var got testFlag
+		err = db.Get("Flags", rashdb.Key{row.Active, row.Name}, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != row {
+			t.Fatalf("Expected %+v, got %+v", row, got)
+		}
+	}
+
+	// The archived column is read from the index keys
+	err = db.View(func(tx *rashdb.Tx) error {
+		c, err := tx.IndexCursor("Flags", "rashdb_index_Flags_archived")
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		err = c.Columns("archived", "active", "name")
+		if err != nil {
+			return err
+		}
+		var got []testFlag
+		for ok, err := c.First(); ok; ok, err = c.Next() {
+			if err != nil {
+				return err
+			}
+			var row testFlag
+			err = c.Scan(&row)
+			if err != nil {
+				return err
+			}
+			got = append(got, row)
+		}
+		// Ordered by archived, then by the primary key
+		expected := []testFlag{rows[0], rows[1], rows[2]}
+		if !reflect.DeepEqual(got, expected) {
+			return fmt.Errorf("Expected %+v, got %+v", expected, got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testPrice struct {
+	Price  float64 `rashdb:"price,pk"`
+	Amount int64   `rashdb:"amount,index"`
+	Note   string
+}
+
+func TestKeyConversion(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	err := db.CreateTable("Prices", testPrice{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		_, err = db.Insert("Prices", testPrice{Price: float64(i), Amount: int64(i * 10), Note: fmt.Sprint(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Integers are converted to reals, as they are on insert
+	var row testPrice
+	err = db.Get("Prices", 2, &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.Note != "2" {
+		t.Fatalf("Unexpected row %+v", row)
+	}
+	err = db.Delete("Prices", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx *rashdb.Tx) error {
+		c, err := tx.Cursor("Prices")
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		ok, err := c.Seek(2)
+		if err != nil || !ok {
+			return fmt.Errorf("Expected to seek to a row, got %v, %v", ok, err)
+		}
+		err = c.Scan(&row)
+		if err != nil {
+			return err
+		}
+		if row.Price != 2 {
+			return fmt.Errorf("Unexpected row %+v", row)
+		}
+		_, err = c.Seek(4)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.GetByIndex("Prices", "rashdb_index_Prices_amount", uint8(10), &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.Price != 1 {
+		t.Fatalf("Unexpected row %+v", row)
+	}
+
+	// Values that don't fit are type errors, rather than keys that aren't found
+	checkTypeError := func(err error, column string, expected app.DataType) {
+		t.Helper()
+		var typeErr *rashdb.ColumnTypeError
+		if !errors.As(err, &typeErr) || !errors.Is(err, rashdb.ErrColumnType) {
+			t.Fatalf("Expected a ColumnTypeError, got %v", err)
+		}
+		if typeErr.Table != "Prices" || typeErr.Column != column || typeErr.Expected != expected || typeErr.Actual != reflect.TypeOf("") {
+			t.Fatalf("Unexpected error %+v", typeErr)
+		}
+	}
+	checkTypeError(db.Get("Prices", "two", &row), "price", app.DBReal)
+	checkTypeError(db.Delete("Prices", "two"), "price", app.DBReal)
+	checkTypeError(db.GetByIndex("Prices", "rashdb_index_Prices_amount", "ten", &row), "amount", app.DBInt)
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx *rashdb.Tx) error {
+		c, err := tx.Cursor("Prices")
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		_, err = c.Seek("two")
+		return err
+	})
+	checkTypeError(err, "price", app.DBReal)
+}
+
+func TestRenameColumnIndexes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := rashdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateTable("People", testTagged{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Insert("People", testTagged{ID: 1, Email: "a@example.com", City: "Oslo", Tags: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RenameColumn("People", "email", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RenameColumn("People", "city", "town")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The generated indexes are named after the new columns, so the old names can be used again
+	err = db.AddColumn("People", "city", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateIndex("People", "rashdb_index_People_city", "city")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = rashdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var row struct {
+		ID   int64  `rashdb:"id,pk"`
+		Mail string `rashdb:"mail"`
+		Town string `rashdb:"town"`
+	}
+	err = db.GetByIndex("People", "rashdb_unique_People_mail", "a@example.com", &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.GetByIndex("People", "rashdb_index_People_town", "Oslo", &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.ID != 1 {
+		t.Fatalf("Unexpected row %+v", row)
+	}
+	err = db.GetByIndex("People", "rashdb_unique_People_email", "a@example.com", &row)
+	if !errors.Is(err, rashdb.ErrUnknownIndexName) {
+		t.Fatalf("Expected ErrUnknownIndexName, got %v", err)
+	}
+	// Once the table is renamed too, a new table can have the old table and column names
+	err = db.RenameTable("People", "OldPeople")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateTable("People", testTagged{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.GetByIndex("OldPeople", "rashdb_unique_OldPeople_mail", "a@example.com", &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Run with -race. DB methods can be called from any goroutine, even while changes outside of a transaction are pending
+func TestImplicitConcurrency(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	err := db.CreateTable("Bars", testBar{}, "Symbol", "Timestamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const numRows = 500
+	var wg sync.WaitGroup
+	wg.Add(2)
+	errs := make(chan error, 2)
+	go func() {
+		defer wg.Done()
+		for ts := uint64(0); ts < numRows; ts++ {
+			_, err := db.Insert("Bars", testBar{Symbol: "SPY", Timestamp: ts, Raw: bytes.Repeat([]byte{1}, 100)})
+			if err != nil {
+				errs <- err
+				return
+			}
+			if ts%100 == 99 {
+				err = db.SyncAll()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for ts := uint64(0); ts < numRows; ts++ {
+			var bar testBar
+			// The row may not be inserted yet
+			err := db.Get("Bars", rashdb.Key{"SPY", ts}, &bar)
+			if err != nil && !errors.Is(err, rashdb.ErrKeyNotFound) {
+				errs <- err
+				return
+			}
+			if err == nil && bar.Timestamp != ts {
+				errs <- fmt.Errorf("Expected timestamp %d, got %+v", ts, bar)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	err = db.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bar testBar
+	err = db.Get("Bars", rashdb.Key{"SPY", uint64(numRows - 1)}, &bar)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,6 +3,9 @@ package rashdb
 import (
 	"errors"
 	"fmt"
+	"reflect"
+
+	"github.com/thomastay/rash-db/pkg/app"
 )
 
 var (
@@ -10,8 +13,124 @@ var (
 	ErrInvalidTableValue  = errors.New("invalid value for table")
 	ErrUnknownTableName   = errors.New("unknown table name")
 	ErrInsertNoPrimaryKey = errors.New("insert: no primary key")
+	ErrKeyNotFound        = errors.New("key not found")
+	ErrDuplicateKey       = errors.New("insert: duplicate key")
+	ErrGetInvalidDest     = errors.New("get: dest must be a non nil pointer to a struct")
+	ErrKeyMismatch        = errors.New("key does not match the primary key columns")
+	ErrTableExists        = errors.New("create table: table already exists")
+	ErrInvalidOpenOptions = errors.New("open: invalid options")
+	ErrTxInProgress       = errors.New("another writable transaction is in progress")
+	ErrTxNotWritable      = errors.New("tx not writable")
+	ErrTxClosed           = errors.New("tx closed")
+	ErrCursorNotOnRow     = errors.New("cursor is not on a row")
+	ErrUnknownIndexName   = errors.New("unknown index name")
+	ErrIndexExists        = errors.New("create index: index already exists")
+	ErrNoIndexColumns     = errors.New("create index: no columns")
+	ErrUniqueConstraint   = errors.New("unique constraint failed")
+	ErrNotNullConstraint  = errors.New("not null constraint failed")
+	ErrColumnType         = errors.New("value does not match the column type")
+	ErrColumnExists       = errors.New("alter table: column already exists")
+	ErrColumnIndexed      = errors.New("alter table: column is indexed")
+	ErrPrimaryKeyTwice    = errors.New("create table: primary key given both in struct tags and in options")
+	ErrSequenceExhausted  = errors.New("insert: the table has run out of IDs")
 )
 
+// A schema row that can't be decoded means that the file isn't a valid DB. The error matches both ErrInvalid and
+// app.ErrCorruptSchema with errors.Is.
+func schemaError(err error) error {
+	if errors.Is(err, app.ErrCorruptSchema) {
+		return fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+	return err
+}
+
 func ErrInsertInvalidKey(name string) error {
 	return fmt.Errorf("insert: invalid key name %s", name)
 }
+
+func ErrGetInvalidKey(name string) error {
+	return fmt.Errorf("get: invalid key name %s", name)
+}
+
+func ErrCreateTableInvalidKey(name string) error {
+	return fmt.Errorf("create table: invalid primary key %s", name)
+}
+
+func ErrCreateTableInvalidUnique(name string) error {
+	return fmt.Errorf("create table: invalid unique column %s", name)
+}
+
+func ErrCreateTableInvalidAutoIncrement(name string) error {
+	return fmt.Errorf("create table: invalid autoincrement column %s", name)
+}
+
+// Returned when a row would have the same value in a unique column as another row.
+// It matches ErrUniqueConstraint with errors.Is.
+type UniqueConstraintError struct {
+	Table  string
+	Column string
+	// The value that is already in the table
+	Value interface{}
+}
+
+func (e *UniqueConstraintError) Error() string {
+	return fmt.Sprintf("unique constraint: %s.%s already has the value %v", e.Table, e.Column, e.Value)
+}
+
+func (e *UniqueConstraintError) Unwrap() error {
+	return ErrUniqueConstraint
+}
+
+// Returned when a row would have NULL in a column which is not null.
+// It matches ErrNotNullConstraint with errors.Is.
+type NotNullConstraintError struct {
+	Table  string
+	Column string
+}
+
+func (e *NotNullConstraintError) Error() string {
+	return fmt.Sprintf("not null constraint: %s.%s cannot be NULL", e.Table, e.Column)
+}
+
+func (e *NotNullConstraintError) Unwrap() error {
+	return ErrNotNullConstraint
+}
+
+// Returned when a value can't be stored in its column, e.g. a string in a DBInt column.
+// It matches ErrColumnType with errors.Is.
+type ColumnTypeError struct {
+	Table  string
+	Column string
+	// The type of the column
+	Expected app.DataType
+	// The Go type of the field that holds the value
+	Actual reflect.Type
+}
+
+func (e *ColumnTypeError) Error() string {
+	return fmt.Sprintf("type check: %s.%s has type %s, which cannot store a %s", e.Table, e.Column, e.Expected, e.Actual)
+}
+
+func (e *ColumnTypeError) Unwrap() error {
+	return ErrColumnType
+}
+
+func ErrInvalidStructTag(field string, option string) error {
+	return fmt.Errorf("struct tag: field %s has an unknown option %s", field, option)
+}
+
+func ErrDuplicateColumn(name string) error {
+	return fmt.Errorf("struct tag: more than one field is called %s", name)
+}
+
+func ErrCreateIndexInvalidColumn(name string) error {
+	return fmt.Errorf("create index: invalid column %s", name)
+}
+
+func ErrProjectionInvalidColumn(name string) error {
+	return fmt.Errorf("columns: invalid column %s", name)
+}
+
+func ErrAlterTableInvalidColumn(name string) error {
+	return fmt.Errorf("alter table: invalid column %s", name)
+}
@@ -0,0 +1,246 @@
+package rashdb
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/thomastay/rash-db/pkg/app"
+)
+
+// The sql.Null* types that can be used as fields, and the type of the column that stores them.
+// They are stored as NULL when they aren't Valid.
+var nullTypes = map[reflect.Type]app.DataType{
+	reflect.TypeOf(sql.NullBool{}):    app.DBInt,
+	reflect.TypeOf(sql.NullByte{}):    app.DBInt,
+	reflect.TypeOf(sql.NullInt16{}):   app.DBInt,
+	reflect.TypeOf(sql.NullInt32{}):   app.DBInt,
+	reflect.TypeOf(sql.NullInt64{}):   app.DBInt,
+	reflect.TypeOf(sql.NullFloat64{}): app.DBReal,
+	reflect.TypeOf(sql.NullString{}):  app.DBStr,
+}
+
+// The type of the column that stores a field of type typ. Returns false if the type can't be stored.
+// Pointers are stored as the value they point to, or as NULL if they are nil.
+func columnType(typ reflect.Type) (app.DataType, bool) {
+	if dataType, ok := nullTypes[typ]; ok {
+		return dataType, true
+	}
+	if typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Bool,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return app.DBInt, true
+	case reflect.Float32, reflect.Float64:
+		return app.DBReal, true
+	case reflect.String:
+		return app.DBStr, true
+	case reflect.Slice:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return app.DBBlob, true
+		}
+		return app.DBJsonArr, true
+	case reflect.Map:
+		// JSON objects only have string keys
+		if typ.Key().Kind() == reflect.String {
+			return app.DBJsonData, true
+		}
+	}
+	return 0, false
+}
+
+// Whether a field of type typ holds an integer, which it has to for an autoincrementing key
+func isIntegerType(typ reflect.Type) bool {
+	if typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+// The value that is stored for a field. nil is stored as NULL
+func fieldValue(field reflect.Value) (interface{}, error) {
+	switch field.Kind() {
+	case reflect.Pointer:
+		if field.IsNil() {
+			return nil, nil
+		}
+		field = field.Elem()
+	case reflect.Slice, reflect.Map:
+		if field.IsNil() {
+			return nil, nil
+		}
+	}
+	if valuer, ok := field.Interface().(driver.Valuer); ok {
+		// The sql.Null* types
+		return valuer.Value()
+	}
+	return field.Interface(), nil
+}
+
+// Checks that val can be stored in a column of type dataType, and converts it to the type that is stored.
+// Integers are stored as int64, except for uint64 values that overflow it, which are stored as they are.
+// Integers can also go into DBReal columns, as float64. Returns false if val doesn't fit the column.
+func convertValue(dataType app.DataType, val interface{}) (interface{}, bool) {
+	if val == nil {
+		return nil, true
+	}
+	v := reflect.ValueOf(val)
+	switch dataType {
+	case app.DBInt:
+		switch v.Kind() {
+		case reflect.Bool:
+			return v.Bool(), true
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return v.Int(), true
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if v.Uint() > math.MaxInt64 {
+				return v.Uint(), true
+			}
+			return int64(v.Uint()), true
+		}
+	case app.DBReal:
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			return v.Float(), true
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return float64(v.Int()), true
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return float64(v.Uint()), true
+		}
+	case app.DBStr, app.DBText:
+		if v.Kind() == reflect.String {
+			return v.String(), true
+		}
+	case app.DBBlob:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Bytes(), true
+		}
+	case app.DBJsonArr:
+		if (v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8) || v.Kind() == reflect.Array {
+			return val, true
+		}
+	case app.DBJsonData:
+		if v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String {
+			return val, true
+		}
+	}
+	return nil, false
+}
+
+// Sets a struct field from a decoded column value.
+// Decoded values are loosely typed (int64, uint64, float64, string, []byte, json.RawMessage, ...), so they are converted to the field's type here.
+// NULL sets the field to its zero value, which is a nil pointer for pointer fields.
+func setField(field reflect.Value, val interface{}) error {
+	if scanner, ok := field.Addr().Interface().(sql.Scanner); ok {
+		// The sql.Null* types
+		return scanner.Scan(val)
+	}
+	if val == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.Pointer:
+		ptr := reflect.New(field.Type().Elem())
+		err := setField(ptr.Elem(), val)
+		if err != nil {
+			return err
+		}
+		field.Set(ptr)
+		return nil
+	case reflect.Bool:
+		switch x := val.(type) {
+		case bool:
+			field.SetBool(x)
+			return nil
+		case int64:
+			// Keys store bools as the integers 0 and 1, see keycodec.Append
+			if x == 0 || x == 1 {
+				field.SetBool(x == 1)
+				return nil
+			}
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		switch x := val.(type) {
+		case int64:
+			n = x
+		case uint64:
+			n = int64(x)
+			if n < 0 {
+				return fmt.Errorf("value %d overflows %s", x, field.Type())
+			}
+		default:
+			return errSetField(field, val)
+		}
+		if field.OverflowInt(n) {
+			return fmt.Errorf("value %d overflows %s", n, field.Type())
+		}
+		field.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+		switch x := val.(type) {
+		case uint64:
+			n = x
+		case int64:
+			if x < 0 {
+				return fmt.Errorf("value %d overflows %s", x, field.Type())
+			}
+			n = uint64(x)
+		default:
+			return errSetField(field, val)
+		}
+		if field.OverflowUint(n) {
+			return fmt.Errorf("value %d overflows %s", n, field.Type())
+		}
+		field.SetUint(n)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		if f, ok := val.(float64); ok {
+			field.SetFloat(f)
+			return nil
+		}
+	case reflect.String:
+		if str, ok := val.(string); ok {
+			field.SetString(str)
+			return nil
+		}
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.Uint8 {
+			if b, ok := val.([]byte); ok {
+				field.SetBytes(b)
+				return nil
+			}
+			return errSetField(field, val)
+		}
+		return setJSONField(field, val)
+	case reflect.Map:
+		return setJSONField(field, val)
+	}
+	return errSetField(field, val)
+}
+
+// JSON arrays and objects are decoded as raw JSON, which encoding/json unmarshals into any slice or map type
+func setJSONField(field reflect.Value, val interface{}) error {
+	b, ok := val.(json.RawMessage)
+	if !ok {
+		return errSetField(field, val)
+	}
+	return json.Unmarshal(b, field.Addr().Interface())
+}
+
+func errSetField(field reflect.Value, val interface{}) error {
+	return fmt.Errorf("cannot store %T in a field of type %s", val, field.Type())
+}
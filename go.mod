@@ -1,9 +1,3 @@
 module github.com/thomastay/rash-db
 
 go 1.20
-
-require github.com/vmihailenco/msgpack/v5 v5.3.5
-
-require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
-
-replace github.com/vmihailenco/msgpack/v5 => ../msgpack
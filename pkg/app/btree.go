@@ -0,0 +1,701 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/thomastay/rash-db/pkg/disk"
+)
+
+// A BTree is a B+tree of opaque, encoded keys and values.
+// Keys are ordered by their bytes (see the keycodec package for an encoding where that matches the order of the values).
+// All keys and values live in the leaf pages. Interior pages hold copies of keys, used to direct searches.
+// Every node is read through the pager, and written back to the pager when modified,
+// so only the pages along the path to a key are ever held in memory.
+//
+// Nodes are copied on write: a node that is part of a committed version moves to a new page when it is modified,
+// and so does every node on the path up to the root. The old pages stay as they are for readers of that version.
+type BTree struct {
+	// Page ID of the current root. This changes whenever the tree is modified, except for the schema table,
+	// whose root is always page 1
+	Root     int
+	PageSize int
+	Pager    *Pager
+
+	// Set for trees that are read as of a snapshot. These can't be modified
+	snapshot *Snapshot
+}
+
+// Opens an existing B-tree rooted at root
+func NewBTree(root int, pager *Pager) *BTree {
+	return &BTree{
+		Root:     root,
+		PageSize: pager.PageSize,
+		Pager:    pager,
+	}
+}
+
+// Creates a new, empty B-tree, which takes up a single leaf page
+func CreateBTree(pager *Pager) (*BTree, error) {
+	t := NewBTree(pager.NextFreePageID(), pager)
+	root := LeafNode{
+		ID:       t.Root,
+		PageSize: t.PageSize,
+	}
+	err := t.writeNode(&root)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Returns the full payload of a cell
+func (t *BTree) payload(cell *disk.Cell) ([]byte, error) {
+	return t.Pager.ReadPayload(cell)
+}
+
+// Reads the node at ID. Exactly one of the returned nodes is not nil.
+func (t *BTree) readNode(ID int) (*LeafNode, *InteriorNode, error) {
+	info, leaf, interior, err := t.requestNode(ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	info.Done()
+	return leaf, interior, nil
+}
+
+// Reads the node at ID, which stays in use until Done is called on the returned PagerInfo.
+// Exactly one of the returned nodes is not nil.
+func (t *BTree) requestNode(ID int) (PagerInfo, *LeafNode, *InteriorNode, error) {
+	var info PagerInfo
+	var err error
+	if t.snapshot != nil {
+		info, err = t.snapshot.Request(ID)
+	} else {
+		info, err = t.Pager.Request(ID)
+	}
+	if err != nil {
+		return PagerInfo{}, nil, nil, err
+	}
+	switch page := info.Page.(type) {
+	case *disk.LeafPage:
+		leaf, err := decodeLeafNode(ID, t.PageSize, page)
+		if err != nil {
+			info.Done()
+			return PagerInfo{}, nil, nil, err
+		}
+		return info, leaf, nil, nil
+	case *disk.InteriorPage:
+		return info, nil, decodeInteriorNode(ID, t.PageSize, page), nil
+	default:
+		info.Done()
+		return PagerInfo{}, nil, nil, fmt.Errorf("Page %d is not a B-tree page", ID)
+	}
+}
+
+type pageEncoder interface {
+	EncodeDataAsPage() (PagerInfo, error)
+}
+
+func (t *BTree) writeNode(n pageEncoder) error {
+	info, err := n.EncodeDataAsPage()
+	if err != nil {
+		return err
+	}
+	return t.Pager.MarkDirty(info)
+}
+
+// Returns the page that a modified node should be written to.
+// Pages of a committed version may still be read, so the node moves to a new page, and the old one is freed.
+// Page 1 is the exception, as it never moves.
+func (t *BTree) copyOnWrite(ID int) int {
+	if ID == DBSchemaPageID || t.Pager.IsFresh(ID) {
+		return ID
+	}
+	t.Pager.FreePage(ID)
+	return t.Pager.NextFreePageID()
+}
+
+// Finds the index of the child of n that may contain key
+func (t *BTree) childIndex(n *InteriorNode, key []byte) (int, error) {
+	// The first separator which is greater than key
+	return search(len(n.Cells), func(i int) (bool, error) {
+		sep, err := t.payload(&n.Cells[i].Key)
+		if err != nil {
+			return false, err
+		}
+		return bytes.Compare(key, sep) < 0, nil
+	})
+}
+
+// Finds the index of the first cell in n whose key is greater than or equal to key.
+// Cell i of the leaf node is the pair of cells at Pointers[2*i] and Pointers[2*i+1] of the leaf page,
+// so this is a binary search over the page's pointers.
+func (t *BTree) lowerBound(n *LeafNode, key []byte) (int, bool, error) {
+	found := false
+	i, err := search(len(n.Data), func(i int) (bool, error) {
+		k, err := t.payload(&n.Data[i].Key)
+		if err != nil {
+			return false, err
+		}
+		c := bytes.Compare(key, k)
+		if c == 0 {
+			found = true
+		}
+		return c <= 0, nil
+	})
+	return i, found, err
+}
+
+// Finds the index of the cell in n whose key is exactly key, or -1
+func (t *BTree) find(n *LeafNode, key []byte) (int, error) {
+	i, found, err := t.lowerBound(n, key)
+	if err != nil || !found {
+		return -1, err
+	}
+	return i, nil
+}
+
+// Binary search for the smallest index i in [0, n) for which f(i) is true, or n if there is none.
+// Same as sort.Search, except that f can fail.
+func search(n int, f func(int) (bool, error)) (int, error) {
+	var searchErr error
+	i := sort.Search(n, func(i int) bool {
+		if searchErr != nil {
+			return false
+		}
+		ok, err := f(i)
+		if err != nil {
+			searchErr = err
+		}
+		return ok
+	})
+	return i, searchErr
+}
+
+// Looks up the value stored under key. Returns false if the key could not be found.
+func (t *BTree) Get(key []byte) ([]byte, bool, error) {
+	ID := t.Root
+	for {
+		leaf, interior, err := t.readNode(ID)
+		if err != nil {
+			return nil, false, err
+		}
+		if interior != nil {
+			i, err := t.childIndex(interior, key)
+			if err != nil {
+				return nil, false, err
+			}
+			ID = interior.Child(i)
+			continue
+		}
+		i, err := t.find(leaf, key)
+		if err != nil || i < 0 {
+			return nil, false, err
+		}
+		val, err := t.payload(&leaf.Data[i].Val)
+		if err != nil {
+			return nil, false, err
+		}
+		return val, true, nil
+	}
+}
+
+// Returned when a node had to be split. The leftmost piece keeps the original page ID,
+// and every other piece is described by one splitResult, in key order.
+type splitResult struct {
+	// Separator: the smallest key in the piece
+	Key   disk.Cell
+	Right int
+}
+
+func (t *BTree) Insert(kv *KeyValue) error {
+	if t.snapshot != nil {
+		return errReadOnlyTree
+	}
+	cell, err := t.Pager.NewLeafCell(kv)
+	if err != nil {
+		return err
+	}
+	root, splits, err := t.insert(t.Root, kv.Key, cell)
+	if err != nil {
+		if err == ErrDuplicateKey {
+			// The cell never made it onto a page
+			t.freeLeafCell(&cell)
+		}
+		return err
+	}
+	t.Root = root
+	// The root was split, so the tree grows by one level (or more, if the new root has to be split too)
+	for len(splits) > 0 {
+		newRoot := InteriorNode{
+			ID:       t.Pager.NextFreePageID(),
+			PageSize: t.PageSize,
+		}
+		newRoot.RightChild = t.Root
+		if t.Root == DBSchemaPageID {
+			// Page 1 is where the DB is read from, so the schema table's root can't move.
+			// Instead, what's on the root moves to the new page, and the new root takes its place.
+			newRoot.ID, newRoot.RightChild = t.Root, newRoot.ID
+			newRoot.DBHeaders, err = t.moveNode(t.Root, newRoot.RightChild)
+			if err != nil {
+				return err
+			}
+		}
+		newRoot.insertSplits(0, splits)
+		t.Root = newRoot.ID
+		splits, err = t.writeInterior(&newRoot)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Inserts the cell into the subtree at ID. Returns the new page ID of the subtree, and its splits
+func (t *BTree) insert(ID int, key []byte, cell LeafCell) (int, []splitResult, error) {
+	leaf, interior, err := t.readNode(ID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if leaf != nil {
+		i, found, err := t.lowerBound(leaf, key)
+		if err != nil {
+			return 0, nil, err
+		}
+		if found {
+			return 0, nil, ErrDuplicateKey
+		}
+		leaf.Data = append(leaf.Data, LeafCell{})
+		copy(leaf.Data[i+1:], leaf.Data[i:])
+		leaf.Data[i] = cell
+		leaf.ID = t.copyOnWrite(leaf.ID)
+		splits, err := t.writeLeaf(leaf)
+		return leaf.ID, splits, err
+	}
+
+	i, err := t.childIndex(interior, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	child, splits, err := t.insert(interior.Child(i), key, cell)
+	if err != nil {
+		return 0, nil, err
+	}
+	interior.SetChild(i, child)
+	interior.insertSplits(i, splits)
+	interior.ID = t.copyOnWrite(interior.ID)
+	splits, err = t.writeInterior(interior)
+	return interior.ID, splits, err
+}
+
+// The i-th child of n was split into pieces. Adds the new pieces as children of n.
+func (n *InteriorNode) insertSplits(i int, splits []splitResult) {
+	cells := make([]disk.InteriorCell, len(splits))
+	left := n.Child(i)
+	for j, split := range splits {
+		cells[j] = disk.InteriorCell{LeftChild: uint32(left), Key: split.Key}
+		left = split.Right
+	}
+	n.Cells = append(n.Cells[:i], append(cells, n.Cells[i:]...)...)
+	n.SetChild(i+len(cells), left)
+}
+
+// Writes the leaf back to the pager, splitting it into as many pages as needed
+func (t *BTree) writeLeaf(leaf *LeafNode) ([]splitResult, error) {
+	if leaf.Size() < leaf.PageSize {
+		return nil, t.writeNode(leaf)
+	}
+	sizes := make([]int, len(leaf.Data))
+	for i := range leaf.Data {
+		sizes[i] = leaf.Data[i].Size()
+	}
+	cuts := cutPoints(sizes, 0, t.pageCapacity(leaf.DBHeaders != nil), false)
+	cuts = append(cuts, len(leaf.Data))
+	splits := make([]splitResult, len(cuts)-1)
+	for j := range splits {
+		piece := LeafNode{
+			ID:       t.Pager.NextFreePageID(),
+			PageSize: t.PageSize,
+			Data:     append([]LeafCell(nil), leaf.Data[cuts[j]:cuts[j+1]]...),
+		}
+		err := t.writeNode(&piece)
+		if err != nil {
+			return nil, err
+		}
+		// The separator is a copy of the key, since the key may later be deleted while the separator stays
+		sep, err := t.Pager.CopyCell(&piece.Data[0].Key)
+		if err != nil {
+			return nil, err
+		}
+		splits[j] = splitResult{Key: sep, Right: piece.ID}
+	}
+	leaf.Data = leaf.Data[:cuts[0]]
+	return splits, t.writeNode(leaf)
+}
+
+// Writes the interior node back to the pager, splitting it into as many pages as needed.
+// The key at every cut moves up to the parent.
+func (t *BTree) writeInterior(n *InteriorNode) ([]splitResult, error) {
+	if n.Size() < n.PageSize {
+		return nil, t.writeNode(n)
+	}
+	sizes := make([]int, len(n.Cells))
+	for i := range n.Cells {
+		sizes[i] = 2 + n.Cells[i].Size()
+	}
+	cuts := cutPoints(sizes, 0, t.pageCapacity(n.DBHeaders != nil), true)
+	splits := make([]splitResult, len(cuts))
+	for j, cut := range cuts {
+		piece := InteriorNode{
+			ID:         t.Pager.NextFreePageID(),
+			PageSize:   t.PageSize,
+			RightChild: n.RightChild,
+		}
+		if j+1 < len(cuts) {
+			piece.Cells = append(piece.Cells, n.Cells[cut+1:cuts[j+1]]...)
+			piece.RightChild = int(n.Cells[cuts[j+1]].LeftChild)
+		} else {
+			piece.Cells = append(piece.Cells, n.Cells[cut+1:]...)
+		}
+		err := t.writeNode(&piece)
+		if err != nil {
+			return nil, err
+		}
+		splits[j] = splitResult{Key: n.Cells[cut].Key, Right: piece.ID}
+	}
+	n.RightChild = int(n.Cells[cuts[0]].LeftChild)
+	n.Cells = n.Cells[:cuts[0]]
+	return splits, t.writeNode(n)
+}
+
+// The number of bytes available for cells (and their pointers) on a page.
+// When the first page is split, every piece is made small enough to stay on the first page.
+func (t *BTree) pageCapacity(hasDBHeader bool) int {
+	if hasDBHeader {
+		return t.PageSize - 1 - pageHeaderSize - disk.DBHeaderSize
+	}
+	return t.PageSize - 1 - pageHeaderSize
+}
+
+// Moves the node at ID from to the page to, returning the DB header if the node had one
+func (t *BTree) moveNode(from, to int) (*disk.Header, error) {
+	leaf, interior, err := t.readNode(from)
+	if err != nil {
+		return nil, err
+	}
+	var header *disk.Header
+	if leaf != nil {
+		leaf.ID, header, leaf.DBHeaders = to, leaf.DBHeaders, nil
+		return header, t.writeNode(leaf)
+	}
+	interior.ID, header, interior.DBHeaders = to, interior.DBHeaders, nil
+	return header, t.writeNode(interior)
+}
+
+// Finds the indexes to cut a list of cells at, so that every piece fits within capacity.
+// The pieces are roughly the same size. If promote is true, the cell at each cut is
+// not part of either piece, since it moves up to the parent.
+func cutPoints(sizes []int, offset int, capacity int, promote bool) []int {
+	total := 0
+	for _, size := range sizes {
+		total += size
+	}
+	if total <= capacity || len(sizes) < 2 {
+		return nil
+	}
+	// Pick the cut which makes the biggest piece as small as possible
+	best, bestSize := 1, total
+	left := 0
+	for m := 1; m < len(sizes); m++ {
+		left += sizes[m-1]
+		right := total - left
+		if promote {
+			right -= sizes[m]
+		}
+		if max(left, right) < bestSize {
+			best, bestSize = m, max(left, right)
+		}
+	}
+	rightStart := best
+	if promote {
+		rightStart++
+	}
+	cuts := cutPoints(sizes[:best], offset, capacity, promote)
+	cuts = append(cuts, offset+best)
+	return append(cuts, cutPoints(sizes[rightStart:], offset+rightStart, capacity, promote)...)
+}
+
+// Deletes key from the tree. Returns false if the key could not be found.
+// Nodes that become underfull are merged with their siblings, and the tree shrinks when the root is left with a single child.
+func (t *BTree) Delete(key []byte) (bool, error) {
+	if t.snapshot != nil {
+		return false, errReadOnlyTree
+	}
+	root, found, _, err := t.delete(t.Root, key)
+	if err != nil || !found {
+		return found, err
+	}
+	t.Root = root
+	_, interior, err := t.readNode(t.Root)
+	if err != nil {
+		return false, err
+	}
+	if interior != nil && len(interior.Cells) == 0 {
+		if t.Root == DBSchemaPageID {
+			// The root can't move, so its only child moves onto it instead
+			return true, t.pullUpChild(interior)
+		}
+		t.Pager.FreePage(interior.ID)
+		t.Root = interior.RightChild
+	}
+	return true, nil
+}
+
+// Replaces the value of a key that is already in the tree. Returns false if the key could not be found.
+func (t *BTree) Update(kv *KeyValue) (bool, error) {
+	found, err := t.Delete(kv.Key)
+	if err != nil || !found {
+		return found, err
+	}
+	return true, t.Insert(kv)
+}
+
+// Inserts kv, replacing the value of its key if the key is already in the tree
+func (t *BTree) Upsert(kv *KeyValue) error {
+	_, err := t.Delete(kv.Key)
+	if err != nil {
+		return err
+	}
+	return t.Insert(kv)
+}
+
+// Deletes key from the subtree at ID. Returns the new page ID of the subtree,
+// whether the key was found, and whether the node is now underfull
+func (t *BTree) delete(ID int, key []byte) (int, bool, bool, error) {
+	leaf, interior, err := t.readNode(ID)
+	if err != nil {
+		return 0, false, false, err
+	}
+	if leaf != nil {
+		i, err := t.find(leaf, key)
+		if err != nil || i < 0 {
+			return ID, false, false, err
+		}
+		err = t.freeLeafCell(&leaf.Data[i])
+		if err != nil {
+			return 0, false, false, err
+		}
+		leaf.Data = append(leaf.Data[:i], leaf.Data[i+1:]...)
+		leaf.ID = t.copyOnWrite(leaf.ID)
+		return leaf.ID, true, t.isUnderfull(leaf.Size()), t.writeNode(leaf)
+	}
+
+	i, err := t.childIndex(interior, key)
+	if err != nil {
+		return 0, false, false, err
+	}
+	child, found, underfull, err := t.delete(interior.Child(i), key)
+	if err != nil || !found {
+		return ID, found, false, err
+	}
+	interior.SetChild(i, child)
+	if underfull {
+		err = t.rebalance(interior, i)
+		if err != nil {
+			return 0, false, false, err
+		}
+	}
+	interior.ID = t.copyOnWrite(interior.ID)
+	return interior.ID, true, t.isUnderfull(interior.Size()), t.writeNode(interior)
+}
+
+func (t *BTree) isUnderfull(size int) bool {
+	return size < usableSpace(t.PageSize)/4
+}
+
+// Merges the i-th child of parent with one of its siblings, if they fit onto one page.
+// Underfull nodes whose siblings are too full are left alone. Only the children are written back to the pager,
+// the caller writes the parent.
+func (t *BTree) rebalance(parent *InteriorNode, i int) error {
+	// Always work with the pair (left, right) = (i, i+1), or (i-1, i) for the rightmost child
+	if i == len(parent.Cells) {
+		i--
+	}
+	if i < 0 {
+		// The parent has a single child, nothing to rebalance with
+		return nil
+	}
+	leftLeaf, leftInterior, err := t.readNode(parent.Child(i))
+	if err != nil {
+		return err
+	}
+	rightLeaf, rightInterior, err := t.readNode(parent.Child(i + 1))
+	if err != nil {
+		return err
+	}
+
+	var merged pageEncoder
+	var fits bool
+	if leftLeaf != nil && rightLeaf != nil {
+		leftLeaf.Data = append(leftLeaf.Data, rightLeaf.Data...)
+		merged, fits = leftLeaf, leftLeaf.Size() < leftLeaf.PageSize
+	} else if leftInterior != nil && rightInterior != nil {
+		// The separator comes down from the parent
+		leftInterior.Cells = append(leftInterior.Cells, disk.InteriorCell{
+			LeftChild: uint32(leftInterior.RightChild),
+			Key:       parent.Cells[i].Key,
+		})
+		leftInterior.Cells = append(leftInterior.Cells, rightInterior.Cells...)
+		leftInterior.RightChild = rightInterior.RightChild
+		merged, fits = leftInterior, leftInterior.Size() < leftInterior.PageSize
+	} else {
+		return fmt.Errorf("Siblings %d and %d are at different heights", parent.Child(i), parent.Child(i+1))
+	}
+	if !fits {
+		return nil
+	}
+	var left int
+	if leftLeaf != nil {
+		leftLeaf.ID = t.copyOnWrite(leftLeaf.ID)
+		left = leftLeaf.ID
+	} else {
+		leftInterior.ID = t.copyOnWrite(leftInterior.ID)
+		left = leftInterior.ID
+	}
+	err = t.writeNode(merged)
+	if err != nil {
+		return err
+	}
+
+	// Merged into the left node. The right node is gone, and so is the separator
+	if leftLeaf != nil {
+		// Separators between interior nodes moved down into the merged node, only leaf separators are gone
+		err = t.Pager.FreeOverflow(&parent.Cells[i].Key)
+		if err != nil {
+			return err
+		}
+	}
+	t.Pager.FreePage(parent.Child(i + 1))
+	parent.SetChild(i+1, left)
+	parent.Cells = append(parent.Cells[:i], parent.Cells[i+1:]...)
+	return nil
+}
+
+// Replaces a root that has a single child with that child, keeping the root's page ID.
+// If the child doesn't fit next to the DB header, the root is left with a single child.
+func (t *BTree) pullUpChild(root *InteriorNode) error {
+	childID := root.RightChild
+	leaf, interior, err := t.readNode(childID)
+	if err != nil {
+		return err
+	}
+	var node pageEncoder
+	var fits bool
+	if leaf != nil {
+		leaf.ID, leaf.DBHeaders = root.ID, root.DBHeaders
+		node, fits = leaf, leaf.Size() < leaf.PageSize
+	} else {
+		interior.ID, interior.DBHeaders = root.ID, root.DBHeaders
+		node, fits = interior, interior.Size() < interior.PageSize
+	}
+	if !fits {
+		return nil
+	}
+	err = t.writeNode(node)
+	if err != nil {
+		return err
+	}
+	t.Pager.FreePage(childID)
+	return nil
+}
+
+// Calls fn on every key and value in the tree, in key order. Stops at the first error.
+func (t *BTree) ForEach(fn func(kv *KeyValue) error) error {
+	return t.forEach(t.Root, fn)
+}
+
+func (t *BTree) forEach(ID int, fn func(kv *KeyValue) error) error {
+	leaf, interior, err := t.readNode(ID)
+	if err != nil {
+		return err
+	}
+	if interior != nil {
+		for i := 0; i <= len(interior.Cells); i++ {
+			err = t.forEach(interior.Child(i), fn)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := range leaf.Data {
+		key, err := t.payload(&leaf.Data[i].Key)
+		if err != nil {
+			return err
+		}
+		val, err := t.payload(&leaf.Data[i].Val)
+		if err != nil {
+			return err
+		}
+		err = fn(&KeyValue{Key: key, Val: val})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Frees every page of the tree, including its overflow pages. The tree can't be used afterwards.
+// The schema table can't be dropped, since it is always at page 1.
+func (t *BTree) Drop() error {
+	if t.snapshot != nil || t.Root == DBSchemaPageID {
+		return errReadOnlyTree
+	}
+	return t.drop(t.Root)
+}
+
+func (t *BTree) drop(ID int) error {
+	leaf, interior, err := t.readNode(ID)
+	if err != nil {
+		return err
+	}
+	if interior != nil {
+		for i := 0; i <= len(interior.Cells); i++ {
+			err = t.drop(interior.Child(i))
+			if err != nil {
+				return err
+			}
+		}
+		for i := range interior.Cells {
+			err = t.Pager.FreeOverflow(&interior.Cells[i].Key)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		for i := range leaf.Data {
+			err = t.freeLeafCell(&leaf.Data[i])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	t.Pager.FreePage(ID)
+	return nil
+}
+
+func (t *BTree) freeLeafCell(cell *LeafCell) error {
+	err := t.Pager.FreeOverflow(&cell.Key)
+	if err != nil {
+		return err
+	}
+	return t.Pager.FreeOverflow(&cell.Val)
+}
+
+var (
+	ErrDuplicateKey = errors.New("duplicate key")
+	errReadOnlyTree = errors.New("B-tree is read only")
+)
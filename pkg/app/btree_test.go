@@ -0,0 +1,293 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestPager(t *testing.T, pageSize int) *Pager {
+	file, err := os.Create(filepath.Join(t.TempDir(), "btree.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return NewPager(pageSize, file)
+}
+
+// Walks the whole tree in order, checking that every leaf is at the same depth
+func collectKeys(t *testing.T, tree *BTree, ID int, depth int, leafDepth *int) [][]byte {
+	leaf, interior, err := tree.readNode(ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf != nil {
+		if *leafDepth == -1 {
+			*leafDepth = depth
+		} else if *leafDepth != depth {
+			t.Fatalf("Leaf %d is at depth %d, expected %d", ID, depth, *leafDepth)
+		}
+		keys := make([][]byte, len(leaf.Data))
+		for i := range leaf.Data {
+			keys[i], err = tree.payload(&leaf.Data[i].Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return keys
+	}
+	keys := make([][]byte, 0)
+	for i := 0; i <= len(interior.Cells); i++ {
+		keys = append(keys, collectKeys(t, tree, interior.Child(i), depth+1, leafDepth)...)
+	}
+	return keys
+}
+
+func checkTree(t *testing.T, tree *BTree, expected map[string]bool) {
+	leafDepth := -1
+	keys := collectKeys(t, tree, tree.Root, 0, &leafDepth)
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected %d keys, got %d", len(expected), len(keys))
+	}
+	for i, key := range keys {
+		if !expected[string(key)] {
+			t.Fatalf("Unexpected key %s", key)
+		}
+		if i > 0 && bytes.Compare(keys[i-1], key) >= 0 {
+			t.Fatalf("Keys out of order: %s, %s", keys[i-1], key)
+		}
+	}
+}
+
+func TestBTreeInsertDelete(t *testing.T) {
+	pager := newTestPager(t, 512)
+	tree, err := CreateBTree(pager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootID := tree.Root
+	expected := make(map[string]bool)
+	r := rand.New(rand.NewSource(1))
+	for _, i := range r.Perm(2000) {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		err = tree.Insert(&KeyValue{Key: key, Val: []byte("some value")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[string(key)] = true
+	}
+	if tree.Root == rootID {
+		t.Fatal("Expected the root to have been split")
+	}
+	checkTree(t, tree, expected)
+
+	// Flushing and reading the pages back from disk shouldn't change anything
+	err = pager.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, tree, expected)
+
+	for _, i := range r.Perm(2000)[:1900] {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		found, err := tree.Delete(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Fatalf("Expected to find %s", key)
+		}
+		delete(expected, string(key))
+	}
+	checkTree(t, tree, expected)
+
+	found, err := tree.Delete([]byte("not a key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("Deleted a key that does not exist")
+	}
+}
+
+func TestBTreeOverflowPages(t *testing.T) {
+	pager := newTestPager(t, 512)
+	tree, err := CreateBTree(pager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]bool)
+	vals := make(map[string][]byte)
+	for i := 0; i < 50; i++ {
+		// Keys and values much larger than a page
+		key := []byte(fmt.Sprintf("%04d%s", i, bytes.Repeat([]byte("k"), 700+i)))
+		val := bytes.Repeat([]byte{byte(i)}, 3000+i)
+		err = tree.Insert(&KeyValue{Key: key, Val: val})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[string(key)] = true
+		vals[string(key)] = val
+	}
+	err = pager.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, tree, expected)
+
+	// Every value should be reassembled from its overflow pages
+	for key, val := range vals {
+		leaf := findLeaf(t, tree, []byte(key))
+		i, err := tree.find(leaf, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 0 {
+			t.Fatalf("Could not find key %s", key[:4])
+		}
+		got, err := pager.ReadPayload(&leaf.Data[i].Val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, val) {
+			t.Fatalf("Value of %s has length %d, expected %d", key[:4], len(got), len(val))
+		}
+	}
+}
+
+func findLeaf(t *testing.T, tree *BTree, key []byte) *LeafNode {
+	ID := tree.Root
+	for {
+		leaf, interior, err := tree.readNode(ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf != nil {
+			return leaf
+		}
+		i, err := tree.childIndex(interior, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ID = interior.Child(i)
+	}
+}
+
+func TestBTreeDuplicateKey(t *testing.T) {
+	pager := newTestPager(t, 512)
+	tree, err := CreateBTree(pager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		err = tree.Insert(&KeyValue{Key: []byte(fmt.Sprint(i)), Val: []byte("val")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tree.Insert(&KeyValue{Key: []byte("42"), Val: []byte("other val")})
+	if err != ErrDuplicateKey {
+		t.Fatalf("Expected ErrDuplicateKey, got %v", err)
+	}
+	val, found, err := tree.Get([]byte("42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || string(val) != "val" {
+		t.Fatalf("Expected the original value, got %s", val)
+	}
+}
+
+func TestBTreeUpdateUpsert(t *testing.T) {
+	pager := newTestPager(t, 512)
+	tree, err := CreateBTree(pager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]bool)
+	for i := 0; i < 300; i++ {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		err = tree.Insert(&KeyValue{Key: key, Val: []byte("v")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[string(key)] = true
+	}
+	// Bigger values split the leaves, and values that spill into overflow pages replace small ones
+	for i := 0; i < 300; i++ {
+		val := bytes.Repeat([]byte{byte(i)}, 10+(i%7)*200)
+		found, err := tree.Update(&KeyValue{Key: []byte(fmt.Sprintf("key%06d", i)), Val: val})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Fatalf("Expected to find key %d", i)
+		}
+	}
+	found, err := tree.Update(&KeyValue{Key: []byte("not a key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("Updated a key that does not exist")
+	}
+	err = tree.Upsert(&KeyValue{Key: []byte("new key"), Val: []byte("new")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected["new key"] = true
+	err = tree.Upsert(&KeyValue{Key: []byte("key000001"), Val: []byte("small")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, tree, expected)
+
+	for i := 0; i < 300; i++ {
+		val, found, err := tree.Get([]byte(fmt.Sprintf("key%06d", i)))
+		if err != nil || !found {
+			t.Fatalf("Expected to find key %d, %v", i, err)
+		}
+		if i == 1 {
+			if string(val) != "small" {
+				t.Fatalf("Expected the upserted value, got %q", val)
+			}
+		} else if !bytes.Equal(val, bytes.Repeat([]byte{byte(i)}, 10+(i%7)*200)) {
+			t.Fatalf("Unexpected value for key %d", i)
+		}
+	}
+}
+
+func TestBTreeDrop(t *testing.T) {
+	pager := newTestPager(t, 512)
+	tree, err := CreateBTree(pager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		// Long keys spill into overflow pages too, and some of them are copied into interior nodes
+		key := append([]byte(fmt.Sprintf("key%06d", i)), bytes.Repeat([]byte{'k'}, (i%5)*200)...)
+		err = tree.Insert(&KeyValue{Key: key, Val: bytes.Repeat([]byte{byte(i)}, (i%3)*400)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = pager.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every page but the schema page belongs to the tree
+	numPages := pager.DBSize() - 1 - len(pager.free)
+	err = tree.Drop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pager.pendingFree) != numPages {
+		t.Fatalf("Expected all %d pages of the tree to be freed, got %d", numPages, len(pager.pendingFree))
+	}
+	if OpenSchemaTree(pager).Drop() == nil {
+		t.Fatal("Expected the schema table not to be dropped")
+	}
+}
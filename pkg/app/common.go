@@ -10,3 +10,39 @@ type readerStartingAt struct {
 func (r readerStartingAt) Read(buf []byte) (int, error) {
 	return r.file.ReadAt(buf, int64(r.offset))
 }
+
+func max(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
+
+func min(x, y int) int {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+// The index of x in xs, or -1 if it isn't there
+func indexOf(xs []int, x int) int {
+	for i, y := range xs {
+		if y == x {
+			return i
+		}
+	}
+	return -1
+}
+
+func equalInts(xs, ys []int) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		if xs[i] != ys[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package app
+
+// A position in a B-tree, which moves over the keys of the tree in order.
+// The cursor holds on to the pages on the path from the root to its current leaf,
+// and gives each one back to the pager as soon as it moves off it.
+// The tree must not be modified while a cursor is open on it.
+type Cursor struct {
+	tree *BTree
+	// The path from the root down to the current leaf. The last frame is the leaf.
+	// Empty if the cursor isn't on any key
+	stack []cursorFrame
+}
+
+type cursorFrame struct {
+	info     PagerInfo
+	leaf     *LeafNode
+	interior *InteriorNode
+	// The current cell of a leaf, or the current child of an interior node
+	index int
+}
+
+// Opens a cursor on the tree. It isn't on any key until it is moved with First, Last or Seek.
+func (t *BTree) Cursor() *Cursor {
+	return &Cursor{tree: t}
+}
+
+// Whether the cursor is on a key
+func (c *Cursor) Valid() bool {
+	if len(c.stack) == 0 {
+		return false
+	}
+	top := &c.stack[len(c.stack)-1]
+	return top.leaf != nil && top.index >= 0 && top.index < len(top.leaf.Data)
+}
+
+// Moves to the smallest key. Returns false if the tree is empty.
+func (c *Cursor) First() (bool, error) {
+	c.Close()
+	err := c.descend(c.tree.Root, false)
+	if err != nil {
+		return false, err
+	}
+	return c.settle(true)
+}
+
+// Moves to the largest key. Returns false if the tree is empty.
+func (c *Cursor) Last() (bool, error) {
+	c.Close()
+	err := c.descend(c.tree.Root, true)
+	if err != nil {
+		return false, err
+	}
+	return c.settle(false)
+}
+
+// Moves to the smallest key that is greater than or equal to key. Returns false if there is no such key.
+func (c *Cursor) Seek(key []byte) (bool, error) {
+	c.Close()
+	ID := c.tree.Root
+	for {
+		info, leaf, interior, err := c.tree.requestNode(ID)
+		if err != nil {
+			c.Close()
+			return false, err
+		}
+		frame := cursorFrame{info: info, leaf: leaf, interior: interior}
+		if interior != nil {
+			frame.index, err = c.tree.childIndex(interior, key)
+			c.stack = append(c.stack, frame)
+			if err != nil {
+				c.Close()
+				return false, err
+			}
+			ID = interior.Child(frame.index)
+			continue
+		}
+		frame.index, _, err = c.tree.lowerBound(leaf, key)
+		c.stack = append(c.stack, frame)
+		if err != nil {
+			c.Close()
+			return false, err
+		}
+		// Every key on the leaf may be smaller than key, in which case the next key is on the next leaf
+		return c.settle(true)
+	}
+}
+
+// Moves to the next key. Returns false once the cursor moves past the largest key.
+func (c *Cursor) Next() (bool, error) {
+	if !c.Valid() {
+		return false, nil
+	}
+	c.stack[len(c.stack)-1].index++
+	return c.settle(true)
+}
+
+// Moves to the previous key. Returns false once the cursor moves past the smallest key.
+func (c *Cursor) Prev() (bool, error) {
+	if !c.Valid() {
+		return false, nil
+	}
+	c.stack[len(c.stack)-1].index--
+	return c.settle(false)
+}
+
+// The key that the cursor is on. The cursor must be Valid.
+func (c *Cursor) Key() ([]byte, error) {
+	top := &c.stack[len(c.stack)-1]
+	return c.tree.payload(&top.leaf.Data[top.index].Key)
+}
+
+// The value of the key that the cursor is on. The cursor must be Valid.
+func (c *Cursor) Value() ([]byte, error) {
+	top := &c.stack[len(c.stack)-1]
+	return c.tree.payload(&top.leaf.Data[top.index].Val)
+}
+
+// Gives every page the cursor holds back to the pager. The cursor can be moved again afterwards.
+func (c *Cursor) Close() {
+	for len(c.stack) > 0 {
+		c.pop()
+	}
+}
+
+func (c *Cursor) pop() {
+	c.stack[len(c.stack)-1].info.Done()
+	c.stack = c.stack[:len(c.stack)-1]
+}
+
+// Walks down from the node at ID to its leftmost leaf, or to its rightmost leaf if last is set
+func (c *Cursor) descend(ID int, last bool) error {
+	for {
+		info, leaf, interior, err := c.tree.requestNode(ID)
+		if err != nil {
+			return err
+		}
+		frame := cursorFrame{info: info, leaf: leaf, interior: interior}
+		if leaf != nil {
+			if last {
+				frame.index = len(leaf.Data) - 1
+			}
+			c.stack = append(c.stack, frame)
+			return nil
+		}
+		if last {
+			frame.index = len(interior.Cells)
+		}
+		c.stack = append(c.stack, frame)
+		ID = interior.Child(frame.index)
+	}
+}
+
+// Once the cursor has moved past either end of its leaf, moves on to the next leaf (or the previous one)
+// until it is on a key. Leaves can be empty, so this may take more than one leaf.
+func (c *Cursor) settle(forward bool) (bool, error) {
+	for len(c.stack) > 0 && !c.Valid() {
+		// Off the end of this leaf, so go up until there is a sibling to go down to
+		c.pop()
+		for len(c.stack) > 0 {
+			top := &c.stack[len(c.stack)-1]
+			if forward {
+				top.index++
+			} else {
+				top.index--
+			}
+			if top.index >= 0 && top.index <= len(top.interior.Cells) {
+				err := c.descend(top.interior.Child(top.index), !forward)
+				if err != nil {
+					c.Close()
+					return false, err
+				}
+				break
+			}
+			c.pop()
+		}
+	}
+	return c.Valid(), nil
+}
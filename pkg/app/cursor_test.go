@@ -0,0 +1,122 @@
+package app
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// The number of pages that requests are still holding on to
+func numPagesInUse(pager *Pager) int {
+	n := 0
+	for _, reqs := range pager.inUse {
+		if len(reqs) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCursor(t *testing.T) {
+	pager := newTestPager(t, 512)
+	tree, err := CreateBTree(pager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := tree.Cursor()
+	ok, err := c.First()
+	if err != nil || ok {
+		t.Fatalf("Expected an empty tree, got %v, %v", ok, err)
+	}
+
+	// Only the even keys are in the tree
+	const numKeys = 1000
+	for _, i := range rand.New(rand.NewSource(1)).Perm(numKeys) {
+		key := []byte(fmt.Sprintf("key%06d", 2*i))
+		err = tree.Insert(&KeyValue{Key: key, Val: []byte(fmt.Sprint(i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = pager.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKey := func(i int) {
+		t.Helper()
+		key, err := c.Key()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("key%06d", 2*i); string(key) != expected {
+			t.Fatalf("Expected %s, got %s", expected, key)
+		}
+		val, err := c.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != fmt.Sprint(i) {
+			t.Fatalf("Expected the value %d, got %s", i, val)
+		}
+	}
+
+	i := 0
+	for ok, err = c.First(); ok; ok, err = c.Next() {
+		checkKey(i)
+		// Only the path down to the current leaf is held
+		if numPagesInUse(pager) != len(c.stack) {
+			t.Fatalf("Expected %d pages in use, got %d", len(c.stack), numPagesInUse(pager))
+		}
+		i++
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != numKeys {
+		t.Fatalf("Expected %d keys, got %d", numKeys, i)
+	}
+	if numPagesInUse(pager) != 0 {
+		t.Fatal("Expected the cursor to release every page at the end of the tree")
+	}
+
+	i = numKeys - 1
+	for ok, err = c.Last(); ok; ok, err = c.Prev() {
+		checkKey(i)
+		i--
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != -1 {
+		t.Fatalf("Expected to walk back to the first key, stopped at %d", i)
+	}
+
+	// Seeking to a missing key lands on the next one
+	for _, i := range []int{0, 1, 2, 555, 2*numKeys - 2, 2*numKeys - 1} {
+		ok, err = c.Seek([]byte(fmt.Sprintf("key%06d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= 2*numKeys-1 {
+			if ok {
+				t.Fatalf("Expected nothing after key %d", i)
+			}
+			continue
+		}
+		if !ok {
+			t.Fatalf("Expected to find a key at or after %d", i)
+		}
+		checkKey((i + 1) / 2)
+		ok, err = c.Prev()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (i > 0) {
+			t.Fatalf("Unexpected key before %d", i)
+		}
+	}
+	c.Close()
+	if numPagesInUse(pager) != 0 {
+		t.Fatal("Expected Close to release every page")
+	}
+}
@@ -0,0 +1,95 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/thomastay/rash-db/pkg/keycodec"
+)
+
+// Represents a secondary index on some of the columns of a table.
+// An index is a B-tree whose keys are the indexed columns of a row, followed by the primary key of the row,
+// and whose values are empty. So rows with the same indexed values sort next to each other, in primary key order,
+// and every row has exactly one key in the index.
+type IndexSchema struct {
+	Name string
+	// The table that the index is on
+	Table string
+	Root  int
+	// The indexed columns, in order. These can be primary key columns too
+	Columns []TableColumn
+	// No two rows may have the same values in the indexed columns.
+	// In the schema row, every column of a unique index is marked as Unique
+	Unique bool
+}
+
+func (idx *IndexSchema) EncodeAsSchemaRow() TableKeyValue {
+	cols := make([]TableColumn, len(idx.Columns))
+	for i, col := range idx.Columns {
+		cols[i] = col
+		cols[i].Unique = idx.Unique
+	}
+	return TableKeyValue{
+		Key: map[string]interface{}{
+			"name": idx.Name,
+		},
+		Val: map[string]interface{}{
+			"primary_key": []TableColumn{},
+			"columns":     cols,
+			"root":        idx.Root,
+			"type":        schemaTypeIndex,
+			"table":       idx.Table,
+		},
+	}
+}
+
+// Marshals the key of a row in the index. primaryKey is the encoded primary key of the row.
+func (idx *IndexSchema) EncodeKey(row *TableKeyValue, primaryKey []byte) ([]byte, error) {
+	var err error
+	buf := make([]byte, 0, len(primaryKey)+16*len(idx.Columns))
+	for _, col := range idx.Columns {
+		buf, err = keycodec.Append(buf, columnValue(row, col.Key))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(buf, primaryKey...), nil
+}
+
+// Whether any of the indexed columns of row is NULL
+func (idx *IndexSchema) HasNull(row *TableKeyValue) bool {
+	for _, col := range idx.Columns {
+		if columnValue(row, col.Key) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// The value of a column of the row, whether it's part of the primary key or not. Missing columns are NULL
+func columnValue(row *TableKeyValue, name string) interface{} {
+	if val, ok := row.Key[name]; ok {
+		return val
+	}
+	return row.Val[name]
+}
+
+// Splits a key of the index into the values of the indexed columns, and the encoded primary key of the row
+func (idx *IndexSchema) DecodeKey(key []byte) ([]interface{}, []byte, error) {
+	vals := make([]interface{}, len(idx.Columns))
+	var err error
+	for i := range vals {
+		vals[i], key, err = keycodec.Decode(key)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return vals, key, nil
+}
+
+// Marshals the values of the first len(vals) indexed columns, to look them up in the index
+func (idx *IndexSchema) EncodeKeyPrefix(vals []interface{}) ([]byte, error) {
+	if len(vals) > len(idx.Columns) {
+		return nil, fmt.Errorf("Key has %d columns, but the index only has %d", len(vals), len(idx.Columns))
+	}
+	return keycodec.Encode(vals...)
+}
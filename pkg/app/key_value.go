@@ -3,12 +3,10 @@
 package app
 
 import (
-	"bytes"
 	"fmt"
-	"io"
 
 	"github.com/thomastay/rash-db/pkg/disk"
-	"github.com/vmihailenco/msgpack/v5"
+	"github.com/thomastay/rash-db/pkg/keycodec"
 )
 
 func DecodeKeyValue(tbl *TableSchema, kv *KeyValue) (*TableKeyValue, error) {
@@ -16,48 +14,47 @@ func DecodeKeyValue(tbl *TableSchema, kv *KeyValue) (*TableKeyValue, error) {
 		Key: make(map[string]interface{}),
 		Val: make(map[string]interface{}),
 	}
-	// feat: multi primary key
-	var keyData interface{}
-	err := msgpack.Unmarshal(kv.Key, &keyData)
+	keyData, err := keycodec.DecodeN(kv.Key, len(tbl.PrimaryKey))
 	if err != nil {
 		return nil, err
 	}
-	result.Key[tbl.PrimaryKey[0].Key] = keyData
+	for i, col := range tbl.PrimaryKey {
+		result.Key[col.Key] = keyData[i]
+	}
 
 	// Values
-	cols := tbl.Columns
-	valBuf := bytes.NewBuffer(kv.Val)
-	decoder := msgpack.NewDecoder(valBuf)
-	decoder.UseLooseInterfaceDecoding(true)
-	for i := 0; i < len(cols); i++ {
-		valData, err := decoder.DecodeInterfaceLoose()
-		if err != nil {
-			if err == io.EOF {
-				return nil, io.ErrUnexpectedEOF
-			}
-			return nil, err
+	vals, err := decodeRecord(tbl.Columns, kv.Val)
+	if err != nil {
+		return nil, err
+	}
+	for i, col := range tbl.Columns {
+		if !col.Dropped {
+			result.Val[col.Key] = vals[i]
 		}
-		col := cols[i]
-		result.Val[col.Key] = valData
 	}
 
 	return &result, nil
 }
 
-func DecodeKeyValuesOnPage(tbl *TableSchema, page *disk.LeafPage) ([]*TableKeyValue, error) {
+// Decodes every key value pair on a leaf page. Payloads that spilled into overflow pages are
+// reassembled by reading the overflow pages through the pager.
+func DecodeKeyValuesOnPage(tbl *TableSchema, page *disk.LeafPage, pager *Pager) ([]*TableKeyValue, error) {
 	if page.NumCells%2 == 1 {
 		return nil, fmt.Errorf("Page has odd number of cells, %d", page.NumCells)
 	}
 	kvs := make([]*TableKeyValue, page.NumCells/2)
 	var key []byte
-	var err error
-	for i, cell := range page.Cells {
+	for i := range page.Cells {
+		payload, err := pager.ReadPayload(&page.Cells[i])
+		if err != nil {
+			return nil, err
+		}
 		if i%2 == 0 {
 			// Key
-			key = cell.PayloadInitial // TODO overflow page
+			key = payload
 		} else {
 			// Val
-			val := cell.PayloadInitial
+			val := payload
 			kv := KeyValue{
 				Key: key,
 				Val: val,
@@ -73,11 +70,11 @@ func DecodeKeyValuesOnPage(tbl *TableSchema, page *disk.LeafPage) ([]*TableKeyVa
 
 func EncodeKeyValue(tbl *TableSchema, kv *TableKeyValue) (*KeyValue, error) {
 	// Marshal primary key and vals
-	keyBytes, err := colsMapToBytes(tbl.PrimaryKey, kv.Key)
+	keyBytes, err := EncodeKey(tbl, kv.Key)
 	if err != nil {
 		return nil, err
 	}
-	valBytes, err := colsMapToBytes(tbl.Columns, kv.Val)
+	valBytes, err := encodeRecord(tbl.Columns, kv.Val)
 	if err != nil {
 		return nil, err
 	}
@@ -87,32 +84,45 @@ func EncodeKeyValue(tbl *TableSchema, kv *TableKeyValue) (*KeyValue, error) {
 	}, nil
 }
 
-type KeyValue struct {
-	// Keys and values are stored as opaque structs and decoded as needed
-	Key []byte
-	Val []byte
+// Marshals just the primary key of a row, e.g. to look it up.
+// Keys are encoded so that their bytes sort in the same order as their values.
+func EncodeKey(tbl *TableSchema, key map[string]interface{}) ([]byte, error) {
+	var err error
+	buf := make([]byte, 0)
+	for _, col := range tbl.PrimaryKey {
+		val, ok := key[col.Key]
+		if !ok {
+			return nil, fmt.Errorf("Column %s not found in database", col.Key)
+		}
+		buf, err = keycodec.Append(buf, val)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
 }
 
-func colsMapToBytes(
-	columnOrder []TableColumn,
-	cols map[string]interface{},
-) ([]byte, error) {
-	var buf bytes.Buffer
-	// TODO use the msgpack pool to speed things up
-	enc := msgpack.NewEncoder(&buf)
-	enc.SetPreserveSign(true)
-	for _, colType := range columnOrder {
-		name := colType.Key
-		if val, ok := cols[name]; ok {
-			err := enc.Encode(val)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			return nil, fmt.Errorf("Column %s not found in database", name)
+// Marshals the values of the first len(vals) primary key columns.
+// Keys are self delimiting, so every key that starts with these values sorts after the prefix, and they sort next to each other.
+func EncodeKeyPrefix(tbl *TableSchema, vals []interface{}) ([]byte, error) {
+	if len(vals) > len(tbl.PrimaryKey) {
+		return nil, fmt.Errorf("Key has %d columns, but the primary key only has %d", len(vals), len(tbl.PrimaryKey))
+	}
+	var err error
+	buf := make([]byte, 0)
+	for _, val := range vals {
+		buf, err = keycodec.Append(buf, val)
+		if err != nil {
+			return nil, err
 		}
 	}
-	return buf.Bytes(), nil
+	return buf, nil
+}
+
+type KeyValue struct {
+	// Keys and values are stored as opaque structs and decoded as needed
+	Key []byte
+	Val []byte
 }
 
 type TableKeyValue struct {
@@ -1,31 +1,58 @@
 package app
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/thomastay/rash-db/pkg/disk"
-	"github.com/thomastay/rash-db/pkg/varint"
 )
 
 // A leaf node represents a leaf page, deserialized into memory
-// When you insert/delete, you act on a leaf page, which then gets written to disk (possibly as multiple pages)
-// and the end of the transaction
+// When you insert/delete, you act on a leaf node, which then gets handed back to the pager
+// and written to disk when the pager is flushed
 type LeafNode struct {
 	ID       int
 	PageSize int
-	// TODO determine - is data sorted on insert? or only on commits?
-	Data    []TableKeyValue
-	Headers *TableSchema
+	// Sorted by key
+	Data []LeafCell
 
-	Pager     *Pager
+	// only for page #1. Nil for any other page
 	DBHeaders *disk.Header
 }
 
-// Assumption: all data fits on a single page
+// A key and its value, as they are laid out on a leaf page
+type LeafCell struct {
+	Key disk.Cell
+	Val disk.Cell
+}
+
+func (c *LeafCell) Size() int {
+	// Each of the key and value need a 2 byte pointer
+	return 4 + c.Key.Size() + c.Val.Size()
+}
+
+// The number of bytes this node takes up when encoded as a page
+func (n *LeafNode) Size() int {
+	size := pageHeaderSize
+	if n.DBHeaders != nil {
+		size += disk.DBHeaderSize
+	}
+	for i := range n.Data {
+		size += n.Data[i].Size()
+	}
+	return size
+}
+
 func (n *LeafNode) EncodeDataAsPage() (PagerInfo, error) {
 	page := disk.LeafPage{}
 	// The number of keys + number of values
 	numCells := 2 * len(n.Data)
-	if numCells > 65536 {
-		panic("TODO: Multi-pages not implemented")
+	if numCells >= 65536 {
+		return PagerInfo{}, errTooManyCells
+	}
+	if n.Size() >= n.PageSize {
+		// Splitting should have happened earlier on
+		return PagerInfo{}, fmt.Errorf("Leaf node %d does not fit on a page", n.ID)
 	}
 	page.NumCells = uint16(numCells)
 	hasDBHeader := n.DBHeaders != nil
@@ -35,54 +62,132 @@ func (n *LeafNode) EncodeDataAsPage() (PagerInfo, error) {
 
 	cells := make([]disk.Cell, numCells)
 	for i, data := range n.Data {
-		// Marshal primary key and vals
-		diskKV, err := EncodeKeyValue(n.Headers, &data)
-		if err != nil {
-			return PagerInfo{}, err
-		}
-		keyBytes, valBytes := diskKV.Key, diskKV.Val
-		// TODO feat: overflow pages
-
-		cells[i*2] = disk.Cell{
-			PayloadLen:     uint64(len(keyBytes)),
-			PayloadInitial: keyBytes,
-		}
-		cells[i*2+1] = disk.Cell{
-			PayloadLen:     uint64(len(valBytes)),
-			PayloadInitial: valBytes,
-		}
+		cells[i*2] = data.Key
+		cells[i*2+1] = data.Val
 	}
 	page.Cells = cells
 
 	// Calculate pointers
-	offsets := make([]uint16, numCells)
-	ptr := 8 + 2*numCells
 	// ^^ 8 bytes header, then 2 bytes each for n pointers
+	start := pageHeaderSize + 2*numCells
 	if hasDBHeader {
-		ptr += disk.DBHeaderSize
+		start += disk.DBHeaderSize
+	}
+	page.Pointers = make([]uint16, numCells)
+	ptr := start
+	for i := range cells {
+		ptr += cells[i].Size()
+		page.Pointers[i] = uint16(ptr)
 	}
 
-	for i := 0; i < len(offsets); i++ {
-		cell := cells[i]
-		ptr += varint.NumBytesNeededToEncode(cell.PayloadLen) + len(cell.PayloadInitial)
-		if cell.OffsetPageID != 0 {
-			ptr += 4
-		}
-		// check for overflow
-		if ptr >= n.PageSize {
-			panic("TODO feat: multiple pages")
+	return PagerInfo{
+		ID:   n.ID,
+		Page: &page,
+	}, nil
+}
+
+func decodeLeafNode(ID int, pageSize int, page *disk.LeafPage) (*LeafNode, error) {
+	if page.NumCells%2 == 1 {
+		return nil, fmt.Errorf("Page has odd number of cells, %d", page.NumCells)
+	}
+	n := LeafNode{
+		ID:        ID,
+		PageSize:  pageSize,
+		Data:      make([]LeafCell, page.NumCells/2),
+		DBHeaders: page.DBHeader,
+	}
+	for i := range n.Data {
+		n.Data[i] = LeafCell{
+			Key: page.Cells[2*i],
+			Val: page.Cells[2*i+1],
 		}
-		offsets[i] = uint16(ptr)
 	}
-	page.Pointers = offsets
+	return &n, nil
+}
+
+// An interior node represents an interior page, deserialized into memory
+type InteriorNode struct {
+	ID       int
+	PageSize int
+	// Sorted by key. The key of cell i is the smallest key that is NOT in cell i's left child
+	Cells      []disk.InteriorCell
+	RightChild int
+
+	// only for page #1. Nil for any other page
+	DBHeaders *disk.Header
+}
+
+func (n *InteriorNode) Size() int {
+	size := pageHeaderSize
+	if n.DBHeaders != nil {
+		size += disk.DBHeaderSize
+	}
+	for i := range n.Cells {
+		size += 2 + n.Cells[i].Size()
+	}
+	return size
+}
 
-	if n.ID == 0 {
-		newFreeLeafPage := n.Pager.NewFreeLeafPage()
-		newFreeLeafPage.Page = &page
-		return newFreeLeafPage, nil
+// The page ID of the i-th child. The right child is the child at len(n.Cells)
+func (n *InteriorNode) Child(i int) int {
+	if i == len(n.Cells) {
+		return n.RightChild
+	}
+	return int(n.Cells[i].LeftChild)
+}
+
+func (n *InteriorNode) SetChild(i int, ID int) {
+	if i == len(n.Cells) {
+		n.RightChild = ID
+		return
+	}
+	n.Cells[i].LeftChild = uint32(ID)
+}
+
+func (n *InteriorNode) EncodeDataAsPage() (PagerInfo, error) {
+	numCells := len(n.Cells)
+	if numCells >= 65536 {
+		return PagerInfo{}, errTooManyCells
+	}
+	if n.Size() >= n.PageSize {
+		return PagerInfo{}, fmt.Errorf("Interior node %d does not fit on a page", n.ID)
+	}
+	page := disk.InteriorPage{
+		NumCells:   uint16(numCells),
+		RightChild: uint32(n.RightChild),
+		Cells:      n.Cells,
+		Pointers:   make([]uint16, numCells),
+		DBHeader:   n.DBHeaders,
+	}
+	ptr := pageHeaderSize + 2*numCells
+	if n.DBHeaders != nil {
+		ptr += disk.DBHeaderSize
+	}
+	for i := range n.Cells {
+		ptr += n.Cells[i].Size()
+		page.Pointers[i] = uint16(ptr)
 	}
 	return PagerInfo{
 		ID:   n.ID,
 		Page: &page,
 	}, nil
 }
+
+func decodeInteriorNode(ID int, pageSize int, page *disk.InteriorPage) *InteriorNode {
+	return &InteriorNode{
+		ID:         ID,
+		PageSize:   pageSize,
+		Cells:      page.Cells,
+		RightChild: int(page.RightChild),
+		DBHeaders:  page.DBHeader,
+	}
+}
+
+// The number of bytes usable for cells on any page, including the first page which also holds the DB header
+func usableSpace(pageSize int) int {
+	return pageSize - pageHeaderSize - disk.DBHeaderSize - 1
+}
+
+const pageHeaderSize = 8
+
+var errTooManyCells = errors.New("too many cells on a page")
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/thomastay/rash-db/pkg/disk"
+)
+
+// Creates the cell for a payload. If the payload is too large to be stored on a B-tree page,
+// only the start of it is kept in the cell, and the rest spills into a chain of overflow pages.
+func (p *Pager) NewCell(payload []byte) (disk.Cell, error) {
+	cell := disk.Cell{
+		PayloadLen:     uint64(len(payload)),
+		PayloadInitial: payload,
+	}
+	maxLocal := maxLocalPayload(p.PageSize)
+	if len(payload) <= maxLocal {
+		return cell, nil
+	}
+	cell.PayloadInitial = payload[:maxLocal]
+	firstID, err := p.writeOverflow(payload[maxLocal:])
+	if err != nil {
+		return disk.Cell{}, err
+	}
+	cell.OffsetPageID = uint32(firstID)
+	return cell, nil
+}
+
+func (p *Pager) NewLeafCell(kv *KeyValue) (LeafCell, error) {
+	key, err := p.NewCell(kv.Key)
+	if err != nil {
+		return LeafCell{}, err
+	}
+	val, err := p.NewCell(kv.Val)
+	if err != nil {
+		return LeafCell{}, err
+	}
+	return LeafCell{Key: key, Val: val}, nil
+}
+
+// Writes rest into a chain of overflow pages, returning the ID of the first one
+func (p *Pager) writeOverflow(rest []byte) (int, error) {
+	capacity := disk.OverflowPageCapacity(p.PageSize)
+	numPages := (len(rest) + capacity - 1) / capacity
+	IDs := make([]int, numPages)
+	for i := range IDs {
+		IDs[i] = p.NextFreePageID()
+	}
+	for i, ID := range IDs {
+		page := disk.OverflowPage{
+			Payload: rest[i*capacity : min(len(rest), (i+1)*capacity)],
+		}
+		if i+1 < len(IDs) {
+			page.Next = uint32(IDs[i+1])
+		}
+		err := p.MarkDirty(PagerInfo{ID: ID, Page: &page})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return IDs[0], nil
+}
+
+// Returns the full payload of a cell, reading its overflow pages if there are any
+func (p *Pager) ReadPayload(cell *disk.Cell) ([]byte, error) {
+	if cell.OffsetPageID == 0 {
+		return cell.PayloadInitial, nil
+	}
+	payloadLen := int(cell.PayloadLen)
+	payload := make([]byte, 0, payloadLen)
+	payload = append(payload, cell.PayloadInitial...)
+	err := p.walkOverflow(cell, func(page *disk.OverflowPage) {
+		payload = append(payload, page.Payload...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) != payloadLen {
+		return nil, fmt.Errorf("Payload has length %d, expected %d", len(payload), payloadLen)
+	}
+	return payload, nil
+}
+
+// Returns a copy of the cell with its own overflow pages, so that the copy can be freed independently of the original
+func (p *Pager) CopyCell(cell *disk.Cell) (disk.Cell, error) {
+	if cell.OffsetPageID == 0 {
+		return *cell, nil
+	}
+	payload, err := p.ReadPayload(cell)
+	if err != nil {
+		return disk.Cell{}, err
+	}
+	return p.NewCell(payload)
+}
+
+// Gives up the overflow pages of a cell which is no longer used
+func (p *Pager) FreeOverflow(cell *disk.Cell) error {
+	IDs := make([]int, 0)
+	ID := int(cell.OffsetPageID)
+	err := p.walkOverflow(cell, func(page *disk.OverflowPage) {
+		IDs = append(IDs, ID)
+		ID = int(page.Next)
+	})
+	if err != nil {
+		return err
+	}
+	for _, ID := range IDs {
+		p.FreePage(ID)
+	}
+	return nil
+}
+
+func (p *Pager) walkOverflow(cell *disk.Cell, fn func(page *disk.OverflowPage)) error {
+	// Bound the number of pages, so that a corrupted chain with a cycle can't loop forever
+	capacity := disk.OverflowPageCapacity(p.PageSize)
+	maxPages := int(cell.PayloadLen)/capacity + 1
+	ID := int(cell.OffsetPageID)
+	for i := 0; ID != 0; i++ {
+		if i >= maxPages {
+			return fmt.Errorf("Overflow chain starting at page %d is too long", cell.OffsetPageID)
+		}
+		info, err := p.Request(ID)
+		if err != nil {
+			return err
+		}
+		page, ok := info.Page.(*disk.OverflowPage)
+		info.Done()
+		if !ok {
+			return fmt.Errorf("Page %d is not an overflow page", ID)
+		}
+		fn(page)
+		ID = int(page.Next)
+	}
+	return nil
+}
+
+// The largest payload that is stored in a cell without spilling into overflow pages.
+// This guarantees that every leaf page can hold at least four key value pairs, so that splitting a page always works.
+func maxLocalPayload(pageSize int) int {
+	// A pair is two 2 byte pointers, and two cells each with a varint length (at most 9 bytes) and an overflow page ID (4 bytes)
+	return (usableSpace(pageSize)/4-4)/2 - 9 - 4
+}
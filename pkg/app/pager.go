@@ -4,16 +4,24 @@ import (
 	"errors"
 	"io"
 	"os"
+	"sort"
+	"sync"
 
 	"github.com/thomastay/rash-db/pkg/common"
 	"github.com/thomastay/rash-db/pkg/disk"
+	"github.com/thomastay/rash-db/pkg/wal"
 )
 
 // A pager is a service that coordinates fetching and writing pages to disk
 // It is also responsible to maintaining the list of pages still accessed by all threads,
 // So we don't delete data from disk before we are able to read it
+//
+// Pages are versioned: every Flush commits a new version of the DB. Pages that are part of a committed version
+// are never changed in place (except for page 1), since readers may still be looking at that version.
+// A page freed by the writer only becomes reusable once every reader that could see it is gone.
+// Free pages are listed on disk in a linked list of freelist trunk pages, which is rewritten by every Flush that changes it.
 type Pager struct {
-	// mu sync.Mutex
+	mu       sync.Mutex
 	PageSize int
 	file     *os.File
 
@@ -22,6 +30,41 @@ type Pager struct {
 	// Don't use zero here! zero is a null value
 	currReqID      uint64
 	nextFreePageID int // points to one past the last page
+	// The number of pages recorded in the DB header on disk. 0 if no header has been written yet
+	headerNumPages int
+	// nextFreePageID as of the last Flush, which is where a rollback goes back to
+	flushedNextFreePageID int
+
+	// Pages that have been modified in memory, but not yet written to disk
+	dirty map[int]disk.Page
+	// Pages that were allocated since the last Flush. No reader can see them, so they can be changed in place
+	fresh map[int]bool
+	// If set, pages are committed to the log instead of being written in place
+	wal *wal.WAL
+
+	// The number of committed versions. Incremented on every Flush
+	version uint64
+	// The number of open snapshots of each version
+	readers map[uint64]int
+	// Page 1 as of the current version, which is shared by snapshots. Nil until a snapshot needs it
+	rootPage disk.Page
+	// Pages freed since the last Flush. They are still part of the current version
+	pendingFree []int
+	// Pages freed by a commit, which readers of earlier versions may still hold
+	freed []freedPages
+	// Pages that nothing refers to any more, which are handed out before the file grows
+	free []int
+	// Every free page as of the last Flush, sorted. This is what the freelist on disk holds
+	savedFreelist []int
+	// The first freelist trunk page and the number of free pages, which go into the DB header
+	freelistTrunk int
+	freelistCount int
+}
+
+type freedPages struct {
+	// The first version that doesn't use the pages
+	version uint64
+	IDs     []int
 }
 
 func NewPager(pageSize int, file *os.File) *Pager {
@@ -31,24 +74,99 @@ func NewPager(pageSize int, file *os.File) *Pager {
 		inUse:          make(map[int]map[uint64]bool),
 		currReqID:      1,
 		nextFreePageID: 2, // 1 is always in use, as the root page
+		dirty:          make(map[int]disk.Page),
+		fresh:          make(map[int]bool),
+		readers:        make(map[uint64]int),
+
+		flushedNextFreePageID: 2,
 	}
 }
 
+// Sets the number of pages in an existing DB, as recorded in its header.
+// New pages are allocated after these.
+func (p *Pager) SetDBSize(numPages int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextFreePageID = numPages + 1
+	p.flushedNextFreePageID = p.nextFreePageID
+	p.headerNumPages = numPages
+}
+
+// Reads in the freelist of an existing DB, starting from its first trunk page.
+// The free pages, trunk pages included, are handed out before the file grows.
+func (p *Pager) LoadFreelist(trunk int, count int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	first := trunk
+	free := make([]int, 0, count)
+	seen := make(map[int]bool, count)
+	addFree := func(ID int) error {
+		if ID <= DBSchemaPageID || ID >= p.nextFreePageID || seen[ID] {
+			return errCorruptFreelist
+		}
+		seen[ID] = true
+		free = append(free, ID)
+		return nil
+	}
+	for trunk != 0 {
+		err := addFree(trunk)
+		if err != nil {
+			return err
+		}
+		page, err := p.readPage(trunk)
+		if err != nil {
+			return err
+		}
+		trunkPage, ok := page.(*disk.FreelistPage)
+		if !ok {
+			return errCorruptFreelist
+		}
+		for _, ID := range trunkPage.PageIDs {
+			err = addFree(int(ID))
+			if err != nil {
+				return err
+			}
+		}
+		trunk = int(trunkPage.Next)
+	}
+	if len(free) != count {
+		return errCorruptFreelist
+	}
+	sort.Ints(free)
+	p.free = free
+	p.savedFreelist = append([]int(nil), free...)
+	p.freelistTrunk = first
+	p.freelistCount = count
+	return nil
+}
+
+// Commits pages to the write-ahead log from now on. Pages in the log are read from there,
+// until they are checkpointed into the DB file.
+func (p *Pager) SetWAL(w *wal.WAL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.wal = w
+}
+
 func (p *Pager) Request(ID int) (PagerInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	if ID == 0 {
 		return PagerInfo{}, errZeroPage
 	}
-	startOffset := p.pageStart(ID)
-	wrappedReader := readerStartingAt{p.file, startOffset}
-	bytes, err := common.ReadExactly(wrappedReader, p.PageSize)
-	if err != nil {
-		return PagerInfo{}, err
-	}
-	page, err := disk.Decode(bytes, p.PageSize, ID)
-	if err != nil {
-		return PagerInfo{}, err
+	page, ok := p.dirty[ID]
+	if !ok {
+		var err error
+		page, err = p.readPage(ID)
+		if err != nil {
+			return PagerInfo{}, err
+		}
 	}
+	return p.track(ID, page), nil
+}
 
+// Records that page ID is in use, until Done is called on the result. p.mu must be held.
+func (p *Pager) track(ID int, page disk.Page) PagerInfo {
 	result := PagerInfo{
 		ID:    ID,
 		Page:  page,
@@ -64,63 +182,368 @@ func (p *Pager) Request(ID int) (PagerInfo, error) {
 	}
 	p.currReqID++
 
-	return result, nil
+	return result
 }
 
-func (p *Pager) WritePage(info PagerInfo) error {
-	// Check some basic details
+func (p *Pager) readPage(ID int) (disk.Page, error) {
+	if p.wal != nil {
+		bytes, ok, err := p.wal.ReadPage(ID)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return disk.Decode(bytes, p.PageSize, ID)
+		}
+	}
+	startOffset := p.pageStart(ID)
+	wrappedReader := readerStartingAt{p.file, startOffset}
+	bytes, err := common.ReadExactly(wrappedReader, p.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	return disk.Decode(bytes, p.PageSize, ID)
+}
+
+// Hands a modified page back to the pager. It is kept in memory until the next Flush.
+func (p *Pager) MarkDirty(info PagerInfo) error {
 	if info.ID == 0 {
 		return errZeroPage
 	}
 	if info.Page == nil {
 		return errors.New("Invalid pager write request")
 	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dirty[info.ID] = info.Page
+	if info.reqID != 0 {
+		info.done()
+	}
+	return nil
+}
 
-	if info.ID == 1 {
-		// Special case the DB header page
-		info.Page.DBHeader.NumPages = uint32(p.DBSize())
+// Whether the page was allocated since the last Flush. Only those pages, and page 1, may be changed in place.
+func (p *Pager) IsFresh(ID int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fresh[ID]
+}
+
+// Gives up a page that is no longer referenced by anything.
+// Pages of the current version are only reused once no reader can see them.
+func (p *Pager) FreePage(ID int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.dirty, ID)
+	if p.fresh[ID] {
+		// Never committed, so it can be reused straight away
+		delete(p.fresh, ID)
+		p.free = append(p.free, ID)
+		return
 	}
+	p.pendingFree = append(p.pendingFree, ID)
+}
 
-	// Write page to disk! Lets go
-	startOffset := p.pageStart(info.ID)
-	pageBytes, err := info.Page.MarshalBinary(p.PageSize)
+// Writes every dirty page to disk, in page order, as a new version.
+// With a write-ahead log, the pages are committed to the log as one transaction.
+func (p *Pager) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Everything that writeFreelist changes, in case the commit fails
+	free, nextFreePageID := append([]int(nil), p.free...), p.nextFreePageID
+	freelistTrunk, freelistCount := p.freelistTrunk, p.freelistCount
+	restore := func() {
+		p.free, p.nextFreePageID = free, nextFreePageID
+		p.freelistTrunk, p.freelistCount = freelistTrunk, freelistCount
+	}
+
+	freelist, freelistChanged := p.writeFreelist()
+	if p.headerNumPages != 0 && (p.headerNumPages != p.dbSize() || freelistChanged) {
+		// The DB header holds the number of pages and the freelist, so it has to be written whenever they change
+		if _, ok := p.dirty[1]; !ok {
+			page, err := p.readPage(1)
+			if err != nil {
+				restore()
+				return err
+			}
+			p.dirty[1] = page
+		}
+	}
+	IDs := make([]int, 0, len(p.dirty))
+	for ID := range p.dirty {
+		IDs = append(IDs, ID)
+	}
+	sort.Ints(IDs)
+	if p.wal != nil {
+		err := p.commit(IDs)
+		if err != nil {
+			restore()
+			return err
+		}
+	} else {
+		for _, ID := range IDs {
+			err := p.writePage(PagerInfo{ID: ID, Page: p.dirty[ID]})
+			if err != nil {
+				restore()
+				return err
+			}
+			delete(p.dirty, ID)
+		}
+	}
+
+	if freelistChanged {
+		p.savedFreelist = freelist
+	}
+	p.version++
+	p.rootPage = nil
+	p.flushedNextFreePageID = p.nextFreePageID
+	p.fresh = make(map[int]bool)
+	if len(p.pendingFree) > 0 {
+		p.freed = append(p.freed, freedPages{version: p.version, IDs: p.pendingFree})
+		p.pendingFree = nil
+	}
+	p.reclaim()
+	if p.wal != nil && p.wal.NumPages() >= checkpointPages {
+		return p.wal.Checkpoint(p.file)
+	}
+	return nil
+}
+
+// Lays the free pages out on trunk pages, if they have changed since the last Flush. p.mu must be held.
+// Returns every free page, sorted, or false if they haven't changed.
+func (p *Pager) writeFreelist() ([]int, bool) {
+	// Pages at the end of the file that were never committed are dropped, instead of being kept as free pages
+	for p.nextFreePageID-1 >= p.flushedNextFreePageID {
+		i := indexOf(p.free, p.nextFreePageID-1)
+		if i < 0 {
+			break
+		}
+		p.free = append(p.free[:i], p.free[i+1:]...)
+		p.nextFreePageID--
+	}
+
+	// Pages that readers may still see are free as far as the file is concerned,
+	// since there are no readers once the DB is reopened
+	all := make([]int, 0, len(p.free)+len(p.pendingFree))
+	all = append(all, p.free...)
+	for _, f := range p.freed {
+		all = append(all, f.IDs...)
+	}
+	all = append(all, p.pendingFree...)
+	sort.Ints(all)
+	if equalInts(all, p.savedFreelist) {
+		return nil, false
+	}
+
+	// Each trunk page lists the IDs of the free pages that aren't trunk pages
+	capacity := disk.FreelistPageCapacity(p.PageSize)
+	numTrunks := (len(all) + capacity) / (capacity + 1)
+	for len(p.free) < numTrunks {
+		// Trunk pages are overwritten, so they can only be pages that no reader can see. Otherwise, the file grows
+		ID := p.nextFreePageID
+		p.nextFreePageID++
+		p.free = append(p.free, ID)
+		all = append(all, ID)
+		numTrunks = (len(all) + capacity) / (capacity + 1)
+	}
+	trunks := append([]int(nil), p.free...)
+	sort.Ints(trunks)
+	trunks = trunks[:numTrunks]
+	isTrunk := make(map[int]bool, numTrunks)
+	for _, ID := range trunks {
+		isTrunk[ID] = true
+	}
+	leaves := make([]uint32, 0, len(all)-numTrunks)
+	for _, ID := range all {
+		if !isTrunk[ID] {
+			leaves = append(leaves, uint32(ID))
+		}
+	}
+	for i, ID := range trunks {
+		page := &disk.FreelistPage{
+			PageIDs: leaves[i*capacity : min((i+1)*capacity, len(leaves))],
+		}
+		if i+1 < len(trunks) {
+			page.Next = uint32(trunks[i+1])
+		}
+		p.dirty[ID] = page
+	}
+
+	p.freelistTrunk = 0
+	if numTrunks > 0 {
+		p.freelistTrunk = trunks[0]
+	}
+	p.freelistCount = len(all)
+	return all, true
+}
+
+// Throws away every change since the last Flush. Pages that were allocated since then are given back.
+func (p *Pager) Rollback() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dirty = make(map[int]disk.Page)
+	p.nextFreePageID = p.flushedNextFreePageID
+	// Pages that were reused go back on the free list, but pages past the end of the file are gone
+	free := make([]int, 0, len(p.free)+len(p.fresh))
+	for _, ID := range p.free {
+		if ID < p.nextFreePageID {
+			free = append(free, ID)
+		}
+	}
+	for ID := range p.fresh {
+		if ID < p.nextFreePageID {
+			free = append(free, ID)
+		}
+	}
+	p.free = free
+	p.fresh = make(map[int]bool)
+	p.pendingFree = nil
+}
+
+// Moves freed pages onto the free list, once no reader can see them. p.mu must be held.
+func (p *Pager) reclaim() {
+	oldest := p.version
+	for version := range p.readers {
+		if version < oldest {
+			oldest = version
+		}
+	}
+	freed := p.freed[:0]
+	for _, f := range p.freed {
+		if f.version > oldest {
+			freed = append(freed, f)
+			continue
+		}
+		stillInUse := make([]int, 0)
+		for _, ID := range f.IDs {
+			if len(p.inUse[ID]) > 0 {
+				stillInUse = append(stillInUse, ID)
+				continue
+			}
+			p.free = append(p.free, ID)
+		}
+		if len(stillInUse) > 0 {
+			freed = append(freed, freedPages{version: f.version, IDs: stillInUse})
+		}
+	}
+	p.freed = freed
+}
+
+// p.mu must be held
+func (p *Pager) commit(IDs []int) error {
+	frames := make([]wal.Frame, len(IDs))
+	for i, ID := range IDs {
+		pageBytes, err := p.marshalPage(PagerInfo{ID: ID, Page: p.dirty[ID]})
+		if err != nil {
+			return err
+		}
+		frames[i] = wal.Frame{PageID: ID, Data: pageBytes}
+	}
+	err := p.wal.Commit(frames, p.dbSize())
+	if err != nil {
+		return err
+	}
+	for _, ID := range IDs {
+		delete(p.dirty, ID)
+	}
+	return nil
+}
+
+// Copies every page in the write-ahead log into the DB file
+func (p *Pager) Checkpoint() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.wal == nil {
+		return nil
+	}
+	return p.wal.Checkpoint(p.file)
+}
+
+// Writes a page in place, bypassing the write-ahead log
+func (p *Pager) WritePage(info PagerInfo) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.writePage(info)
+}
+
+func (p *Pager) writePage(info PagerInfo) error {
+	pageBytes, err := p.marshalPage(info)
 	if err != nil {
 		return err
 	}
+
+	// Write page to disk! Lets go
+	startOffset := p.pageStart(info.ID)
 	written, err := p.file.WriteAt(pageBytes, startOffset)
 	if err != nil {
 		return err
 	}
 	if written != p.PageSize {
-		// TODO: rollback? There is no way to recover here!
-		// This will be fixed when we implement MVCC
+		// A short write is only recoverable through the write-ahead log
 		return io.ErrShortWrite
 	}
 	if info.reqID != 0 {
 		// This is an existing pagerInfo that came from a read request.
 		// Mark it as read
-		info.Done()
+		info.done()
 	}
 	return nil
 }
 
-func (p *Pager) DBSize() (result int) {
-	result = p.nextFreePageID - 1 // page 0 doesn't exist
-	return
+func (p *Pager) marshalPage(info PagerInfo) ([]byte, error) {
+	// Check some basic details
+	if info.ID == 0 {
+		return nil, errZeroPage
+	}
+	if info.Page == nil {
+		return nil, errors.New("Invalid pager write request")
+	}
+
+	if info.ID == 1 {
+		// Special case the DB header page
+		var header *disk.Header
+		switch page := info.Page.(type) {
+		case *disk.LeafPage:
+			header = page.DBHeader
+		case *disk.InteriorPage:
+			header = page.DBHeader
+		}
+		if header != nil {
+			header.NumPages = uint32(p.dbSize())
+			header.FreelistTrunk = uint32(p.freelistTrunk)
+			header.FreelistCount = uint32(p.freelistCount)
+			p.headerNumPages = p.dbSize()
+		}
+	}
+
+	return info.Page.MarshalBinary(p.PageSize)
 }
 
-func (p *Pager) NextFreePageID() (result int) {
-	result = p.nextFreePageID
-	p.nextFreePageID++
+// The number of pages in the DB, including free pages
+func (p *Pager) DBSize() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dbSize()
+}
+
+// p.mu must be held
+func (p *Pager) dbSize() (result int) {
+	result = p.nextFreePageID - 1 // page 0 doesn't exist
 	return
 }
 
-func (p *Pager) NewFreeLeafPage() PagerInfo {
-	result := PagerInfo{
-		ID: p.nextFreePageID,
+// Allocates a page, reusing a free page if there is one
+func (p *Pager) NextFreePageID() (result int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n := len(p.free); n > 0 {
+		result = p.free[n-1]
+		p.free = p.free[:n-1]
+	} else {
+		result = p.nextFreePageID
+		p.nextFreePageID++
 	}
-	p.nextFreePageID++
-	return result
+	p.fresh[result] = true
+	return
 }
 
 func (p *Pager) pageStart(ID int) int64 {
@@ -133,14 +556,27 @@ func (p *Pager) pageStart(ID int) int64 {
 type PagerInfo struct {
 	// the Page ID
 	ID   int
-	Page *disk.LeafPage
+	Page disk.Page
 
 	pager *Pager
 	reqID uint64
 }
 
 func (info *PagerInfo) Done() {
+	info.pager.mu.Lock()
+	defer info.pager.mu.Unlock()
+	info.done()
+}
+
+// p.mu must be held
+func (info *PagerInfo) done() {
 	delete(info.pager.inUse[info.ID], info.reqID)
 }
 
-var errZeroPage = errors.New("Pager: Page 0 is the null page")
+// The write-ahead log is checkpointed once it holds this many pages
+const checkpointPages = 1000
+
+var (
+	errZeroPage        = errors.New("Pager: Page 0 is the null page")
+	errCorruptFreelist = errors.New("Pager: the freelist is corrupt")
+)
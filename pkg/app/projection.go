@@ -0,0 +1,110 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/thomastay/rash-db/pkg/keycodec"
+)
+
+// Decodes only some of the columns of a row. The other columns are skipped over, without decoding them.
+// The primary key is only decoded up to the last column that is asked for.
+type Projection struct {
+	// The columns, in the order that Decode returns them
+	Names []string
+	// The position in Names of each column of the key, or -1 if it isn't wanted
+	keyIndex []int
+	// The number of key columns that have to be decoded
+	numKeyCols int
+	// The position in Names of each column of the value, or -1 if it isn't wanted
+	valIndex []int
+	// Whether any column of the value is wanted
+	anyVal bool
+}
+
+// Projects the given columns out of the rows of a table
+func NewProjection(tbl *TableSchema, names []string) (*Projection, error) {
+	return newProjection(tbl.PrimaryKey, tbl.Columns, names)
+}
+
+// Projects the given columns out of the keys of an index, which hold the indexed columns and then the primary key.
+// Returns nil if some of the columns aren't in the index, in which case they have to be read from the table.
+func NewIndexProjection(tbl *TableSchema, idx *IndexSchema, names []string) *Projection {
+	keyCols := make([]TableColumn, 0, len(idx.Columns)+len(tbl.PrimaryKey))
+	keyCols = append(keyCols, idx.Columns...)
+	keyCols = append(keyCols, tbl.PrimaryKey...)
+	p, err := newProjection(keyCols, nil, names)
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+func newProjection(keyCols []TableColumn, valCols []TableColumn, names []string) (*Projection, error) {
+	p := Projection{
+		Names:    names,
+		keyIndex: make([]int, len(keyCols)),
+		valIndex: make([]int, len(valCols)),
+	}
+	for i := range p.keyIndex {
+		p.keyIndex[i] = -1
+	}
+	for i := range p.valIndex {
+		p.valIndex[i] = -1
+	}
+	for pos, name := range names {
+		// An index may hold a column twice, since it can index primary key columns
+		if i := columnPosition(keyCols, name); i >= 0 {
+			if p.keyIndex[i] >= 0 {
+				return nil, fmt.Errorf("Column %s is projected twice", name)
+			}
+			p.keyIndex[i] = pos
+			p.numKeyCols = max(p.numKeyCols, i+1)
+			continue
+		}
+		if i := columnPosition(valCols, name); i >= 0 {
+			if p.valIndex[i] >= 0 {
+				return nil, fmt.Errorf("Column %s is projected twice", name)
+			}
+			p.valIndex[i] = pos
+			p.anyVal = true
+			continue
+		}
+		return nil, fmt.Errorf("Column %s not found in database", name)
+	}
+	return &p, nil
+}
+
+// Returns the first position of the column called name, or -1. Dropped columns are skipped
+func columnPosition(cols []TableColumn, name string) int {
+	for i, col := range cols {
+		if col.Key == name && !col.Dropped {
+			return i
+		}
+	}
+	return -1
+}
+
+// Decodes the projected columns of a row, in the order of Names
+func (p *Projection) Decode(kv *KeyValue) ([]interface{}, error) {
+	vals := make([]interface{}, len(p.Names))
+	key := kv.Key
+	for i := 0; i < p.numKeyCols; i++ {
+		var val interface{}
+		var err error
+		val, key, err = keycodec.Decode(key)
+		if err != nil {
+			return nil, err
+		}
+		if pos := p.keyIndex[i]; pos >= 0 {
+			vals[pos] = val
+		}
+	}
+	if !p.anyVal {
+		return vals, nil
+	}
+	err := decodeRecordColumns(kv.Val, len(p.valIndex), p.valIndex, vals)
+	if err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProjection(t *testing.T) {
+	tbl := TableSchema{
+		Name:       "bars",
+		PrimaryKey: []TableColumn{{Key: "symbol", Value: DBStr}, {Key: "ts", Value: DBInt}},
+		Columns: []TableColumn{
+			{Key: "open", Value: DBReal},
+			{Key: "tags", Value: DBJsonArr},
+			{Key: "close", Value: DBReal},
+		},
+	}
+	row := TableKeyValue{
+		Key: map[string]interface{}{"symbol": "SPY", "ts": int64(7)},
+		Val: map[string]interface{}{"open": 1.5, "tags": []string{"a", "b"}, "close": 2.5},
+	}
+	kv, err := EncodeKeyValue(&tbl, &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProjection(&tbl, []string{"close", "symbol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.numKeyCols != 1 {
+		t.Fatalf("Expected to decode only the first key column, got %d", p.numKeyCols)
+	}
+	vals, err := p.Decode(kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []interface{}{2.5, "SPY"}; !reflect.DeepEqual(vals, expected) {
+		t.Fatalf("Expected %v, got %v", expected, vals)
+	}
+	// Key columns only don't need the value at all
+	p, err = NewProjection(&tbl, []string{"ts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, err = p.Decode(&KeyValue{Key: kv.Key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 1 || vals[0] != int64(7) {
+		t.Fatalf("Expected [7], got %v", vals)
+	}
+	for _, names := range [][]string{{"missing"}, {"open", "open"}} {
+		_, err = NewProjection(&tbl, names)
+		if err == nil {
+			t.Fatalf("Expected an error for %v", names)
+		}
+	}
+
+	idx := IndexSchema{Name: "by_close", Table: "bars", Columns: []TableColumn{{Key: "close", Value: DBReal}}}
+	indexKey, err := idx.EncodeKey(&row, kv.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = NewIndexProjection(&tbl, &idx, []string{"ts", "close"})
+	if p == nil {
+		t.Fatal("Expected the index to hold ts and close")
+	}
+	vals, err = p.Decode(&KeyValue{Key: indexKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []interface{}{int64(7), 2.5}; !reflect.DeepEqual(vals, expected) {
+		t.Fatalf("Expected %v, got %v", expected, vals)
+	}
+	if NewIndexProjection(&tbl, &idx, []string{"open"}) != nil {
+		t.Fatal("Expected the index not to hold open")
+	}
+}
@@ -0,0 +1,245 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+
+	"github.com/thomastay/rash-db/pkg/varint"
+)
+
+// The values of a row (everything but the primary key) are stored as a record, which is similar to sqlite's record format.
+// See https://www.sqlite.org/fileformat2.html#record_format
+//
+// ## Encoding
+// A record starts with a header: the length of the rest of the header as a varint, then the serial type of
+// every column as a varint. The bodies of the columns follow, in the same order. The serial type says how
+// to read a body, and how long it is:
+//
+// 0: NULL, no body
+// 1 and 2: false and true, no body
+// 3-10: a signed integer, as a big-endian two's complement integer of (type-2) bytes
+// 11: an unsigned integer that doesn't fit in an int64, as an 8 byte big-endian integer
+// 12: a real, as its 8 byte big-endian IEEE 754 bits
+// 13 and up: a string, blob or JSON body of (type-13)/3 bytes. (type-13)%3 is 0 for strings, 1 for blobs and 2 for JSON
+//
+// A record may have fewer columns than its table has, in which case the missing columns are NULL.
+const (
+	serialNull   = 0
+	serialFalse  = 1
+	serialTrue   = 2
+	serialInt    = 3 // up to serialInt+7
+	serialUint64 = 11
+	serialReal   = 12
+	serialVarLen = 13
+)
+
+// The kinds of variable length bodies
+const (
+	varLenString = iota
+	varLenBlob
+	varLenJSON
+	numVarLenKinds
+)
+
+var errCorruptRecord = errors.New("record: invalid record")
+
+// Marshals the values of cols as a record, in column order. Columns that are missing from vals, or dropped, are NULL.
+// JSON columns are marshalled with encoding/json.
+func encodeRecord(cols []TableColumn, vals map[string]interface{}) ([]byte, error) {
+	header := make([]byte, 0, len(cols))
+	var body []byte
+	for _, col := range cols {
+		val := vals[col.Key]
+		if col.Dropped {
+			// A live column may have the same name
+			val = nil
+		}
+		var serial uint64
+		var err error
+		serial, body, err = appendColumn(body, col, val)
+		if err != nil {
+			return nil, fmt.Errorf("record: column %s: %w", col.Key, err)
+		}
+		header = append(header, varint.Encode64(serial)...)
+	}
+	record := varint.Encode64(uint64(len(header)))
+	record = append(record, header...)
+	return append(record, body...), nil
+}
+
+// Appends the body of a column value to body, and returns its serial type
+func appendColumn(body []byte, col TableColumn, val interface{}) (uint64, []byte, error) {
+	if val == nil {
+		return serialNull, body, nil
+	}
+	if col.Value == DBJsonArr || col.Value == DBJsonData {
+		b, ok := val.(json.RawMessage)
+		if !ok {
+			var err error
+			b, err = json.Marshal(val)
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		return varLenSerial(varLenJSON, len(b)), append(body, b...), nil
+	}
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return serialTrue, body, nil
+		}
+		return serialFalse, body, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendInt(body, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() <= math.MaxInt64 {
+			return appendInt(body, int64(v.Uint()))
+		}
+		return serialUint64, binary.BigEndian.AppendUint64(body, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return serialReal, binary.BigEndian.AppendUint64(body, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return varLenSerial(varLenString, v.Len()), append(body, v.String()...), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return varLenSerial(varLenBlob, v.Len()), append(body, v.Bytes()...), nil
+		}
+	}
+	return 0, nil, fmt.Errorf("cannot encode a value of type %T", val)
+}
+
+// Appends x in as few bytes as it fits in
+func appendInt(body []byte, x int64) (uint64, []byte, error) {
+	n := 1
+	for n < 8 && (x < -(1<<(8*n-1)) || x >= 1<<(8*n-1)) {
+		n++
+	}
+	for i := n - 1; i >= 0; i-- {
+		body = append(body, byte(x>>(8*i)))
+	}
+	return uint64(serialInt + n - 1), body, nil
+}
+
+func varLenSerial(kind int, n int) uint64 {
+	return uint64(serialVarLen + numVarLenKinds*n + kind)
+}
+
+// Unmarshals a record into the values of cols, in column order.
+// Integers are decoded as int64, unless they only fit in a uint64, and reals as float64.
+// JSON columns are decoded as json.RawMessage, so that they can be unmarshalled exactly as encoding/json would.
+func decodeRecord(cols []TableColumn, record []byte) ([]interface{}, error) {
+	vals := make([]interface{}, len(cols))
+	err := decodeRecordColumns(record, len(cols), nil, vals)
+	if err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// Unmarshals some of the columns of a record, which has at most numCols columns.
+// Column i goes into out[outIndex[i]], or is skipped over without being decoded if outIndex[i] is -1.
+// A nil outIndex decodes column i into out[i].
+func decodeRecordColumns(record []byte, numCols int, outIndex []int, out []interface{}) error {
+	r := bytes.NewReader(record)
+	headerLen, err := varint.Decode(r)
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if headerLen > uint64(r.Len()) {
+		return errCorruptRecord
+	}
+	bodyStart := len(record) - r.Len() + int(headerLen)
+	header := bytes.NewReader(record[len(record)-r.Len() : bodyStart])
+	body := record[bodyStart:]
+
+	for i := 0; header.Len() > 0; i++ {
+		if i >= numCols {
+			return errCorruptRecord
+		}
+		serial, err := varint.Decode(header)
+		if err != nil {
+			return errCorruptRecord
+		}
+		pos := i
+		if outIndex != nil {
+			pos = outIndex[i]
+		}
+		if pos < 0 {
+			n := serialBodyLen(serial)
+			if uint64(len(body)) < n {
+				return io.ErrUnexpectedEOF
+			}
+			body = body[n:]
+			continue
+		}
+		out[pos], body, err = decodeColumn(serial, body)
+		if err != nil {
+			return err
+		}
+	}
+	if len(body) != 0 {
+		return errCorruptRecord
+	}
+	return nil
+}
+
+// The length of the body of a column with the given serial type
+func serialBodyLen(serial uint64) uint64 {
+	switch {
+	case serial <= serialTrue:
+		return 0
+	case serial < serialUint64:
+		return serial - serialInt + 1
+	case serial <= serialReal:
+		return 8
+	}
+	return (serial - serialVarLen) / numVarLenKinds
+}
+
+// Reads the body of a column from the start of body, and returns the rest of body
+func decodeColumn(serial uint64, body []byte) (interface{}, []byte, error) {
+	n := serialBodyLen(serial)
+	if uint64(len(body)) < n {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	switch {
+	case serial == serialNull:
+		return nil, body, nil
+	case serial == serialFalse:
+		return false, body, nil
+	case serial == serialTrue:
+		return true, body, nil
+	case serial < serialUint64:
+		// Sign extend from the first byte
+		x := int64(int8(body[0]))
+		for _, b := range body[1:n] {
+			x = x<<8 | int64(b)
+		}
+		return x, body[n:], nil
+	case serial == serialUint64:
+		return binary.BigEndian.Uint64(body), body[8:], nil
+	case serial == serialReal:
+		return math.Float64frombits(binary.BigEndian.Uint64(body)), body[8:], nil
+	}
+	kind := (serial - serialVarLen) % numVarLenKinds
+	// Copy the body, since record may be a page that will be reused
+	b := body[:n]
+	switch kind {
+	case varLenString:
+		return string(b), body[n:], nil
+	case varLenBlob:
+		return bytes.Clone(b), body[n:], nil
+	default:
+		return json.RawMessage(bytes.Clone(b)), body[n:], nil
+	}
+}
@@ -0,0 +1,148 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	cols := []TableColumn{
+		{Key: "null", Value: DBStr},
+		{Key: "false", Value: DBInt},
+		{Key: "true", Value: DBInt},
+		{Key: "str", Value: DBStr},
+		{Key: "text", Value: DBText},
+		{Key: "real", Value: DBReal},
+		{Key: "blob", Value: DBBlob},
+		{Key: "emptyBlob", Value: DBBlob},
+		{Key: "arr", Value: DBJsonArr},
+		{Key: "obj", Value: DBJsonData},
+		{Key: "raw", Value: DBJsonData},
+		{Key: "big", Value: DBInt},
+	}
+	vals := map[string]interface{}{
+		"false":     false,
+		"true":      true,
+		"str":       "héllo\x00world",
+		"text":      "",
+		"real":      -1.25,
+		"blob":      []byte{0, 1, 2, 255},
+		"emptyBlob": []byte{},
+		"arr":       []int64{math.MaxInt64, -1},
+		"obj":       map[string]interface{}{"a": []string{"b"}},
+		"raw":       json.RawMessage(`{"x":1}`),
+		"big":       uint64(math.MaxUint64),
+	}
+	record, err := encodeRecord(cols, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeRecord(cols, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{
+		nil, false, true, "héllo\x00world", "", -1.25, []byte{0, 1, 2, 255}, []byte{},
+		json.RawMessage(`[9223372036854775807,-1]`), json.RawMessage(`{"a":["b"]}`), json.RawMessage(`{"x":1}`),
+		uint64(math.MaxUint64),
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Fatalf("Expected %v, got %v", expected, decoded)
+	}
+
+	// Records can have fewer columns than the table, e.g. if a column was added later
+	decoded, err = decodeRecord(append(cols, TableColumn{Key: "extra", Value: DBInt}), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded[len(cols)] != nil {
+		t.Fatalf("Expected the extra column to be NULL, got %v", decoded[len(cols)])
+	}
+	_, err = decodeRecord(cols[:3], record)
+	if err == nil {
+		t.Fatal("Expected an error for a record with more columns than the table")
+	}
+	_, err = decodeRecord(cols, record[:len(record)-1])
+	if err == nil {
+		t.Fatal("Expected an error for a truncated record")
+	}
+}
+
+func TestRecordInts(t *testing.T) {
+	cols := []TableColumn{{Key: "n", Value: DBInt}}
+	ints := []int64{0, 1, -1, 127, 128, -128, -129, 255, 256, 1<<31 - 1, -1 << 31, 1 << 40, math.MaxInt64, math.MinInt64}
+	prevLen := 0
+	for _, n := range ints {
+		record, err := encodeRecord(cols, map[string]interface{}{"n": n})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeRecord(cols, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded[0] != n {
+			t.Fatalf("Expected %d, got %v", n, decoded[0])
+		}
+		if n == 0 {
+			prevLen = len(record)
+		}
+	}
+	// Small numbers take a single byte, and unsigned numbers are stored the same way as signed ones
+	record, err := encodeRecord(cols, map[string]interface{}{"n": uint8(5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := encodeRecord(cols, map[string]interface{}{"n": int64(5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record) != prevLen || !bytes.Equal(record, other) {
+		t.Fatalf("Expected a %d byte record, got %x and %x", prevLen, record, other)
+	}
+}
+
+func TestRecordDroppedColumns(t *testing.T) {
+	tbl := TableSchema{
+		Name:       "users",
+		PrimaryKey: []TableColumn{{Key: "id", Value: DBInt}},
+		Columns:    []TableColumn{{Key: "name", Value: DBStr}, {Key: "age", Value: DBInt}},
+	}
+	row := TableKeyValue{
+		Key: map[string]interface{}{"id": int64(1)},
+		Val: map[string]interface{}{"name": "Ada", "age": int64(36)},
+	}
+	kv, err := EncodeKeyValue(&tbl, &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Once age is dropped, a new column can reuse its name without seeing its old values
+	tbl.Columns[1].Dropped = true
+	tbl.Columns = append(tbl.Columns, TableColumn{Key: "age", Value: DBStr})
+	decoded, err := DecodeKeyValue(&tbl, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"name": "Ada", "age": nil}
+	if !reflect.DeepEqual(decoded.Val, expected) {
+		t.Fatalf("Expected %v, got %v", expected, decoded.Val)
+	}
+	decoded.Val["age"] = "old"
+	kv, err = EncodeKeyValue(&tbl, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, err := decodeRecord(tbl.Columns, kv.Val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, []interface{}{"Ada", nil, "old"}) {
+		t.Fatalf("Expected the dropped column to be NULL, got %v", vals)
+	}
+	if cols := tbl.LiveColumns(); len(cols) != 2 || cols[1].Value != DBStr {
+		t.Fatalf("Unexpected live columns %+v", cols)
+	}
+}
@@ -0,0 +1,76 @@
+package app
+
+import (
+	"errors"
+
+	"github.com/thomastay/rash-db/pkg/disk"
+)
+
+// A read-only view of the DB as of a committed version.
+// The writer never changes the pages of a committed version in place, so a snapshot reads them through the pager as usual.
+// The exception is page 1, which the snapshot keeps its own copy of.
+type Snapshot struct {
+	pager   *Pager
+	Version uint64
+	// Page 1 as of Version
+	root   disk.Page
+	closed bool
+}
+
+// Opens a snapshot of the last committed version. Pages freed after that version are kept until the snapshot is closed.
+func (p *Pager) BeginRead() (*Snapshot, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rootPage == nil {
+		// Skip the dirty pages, those aren't committed
+		page, err := p.readPage(DBSchemaPageID)
+		if err != nil {
+			return nil, err
+		}
+		p.rootPage = page
+	}
+	p.readers[p.version]++
+	return &Snapshot{
+		pager:   p,
+		Version: p.version,
+		root:    p.rootPage,
+	}, nil
+}
+
+// Fetches a page as of the snapshot's version
+func (s *Snapshot) Request(ID int) (PagerInfo, error) {
+	if s.closed {
+		return PagerInfo{}, errSnapshotClosed
+	}
+	if ID != DBSchemaPageID {
+		return s.pager.Request(ID)
+	}
+	s.pager.mu.Lock()
+	defer s.pager.mu.Unlock()
+	return s.pager.track(ID, s.root), nil
+}
+
+// Opens the B-tree rooted at root, as of the snapshot's version. The tree can't be modified.
+func (s *Snapshot) OpenBTree(root int) *BTree {
+	t := NewBTree(root, s.pager)
+	t.snapshot = s
+	return t
+}
+
+// Ends the snapshot, which lets the pages it could see be reused
+func (s *Snapshot) Close() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	p := s.pager
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readers[s.Version]--
+	if p.readers[s.Version] == 0 {
+		delete(p.readers, s.Version)
+	}
+	p.reclaim()
+}
+
+var errSnapshotClosed = errors.New("snapshot is closed")
@@ -0,0 +1,84 @@
+package app
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/thomastay/rash-db/pkg/disk"
+)
+
+func TestSnapshotReclaim(t *testing.T) {
+	pager := newTestPager(t, 512)
+	tree, err := CreateBTree(pager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Page 1 has to exist for a snapshot
+	_, err = CreateSchemaTree(pager, &disk.Header{PageSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]bool)
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		err = tree.Insert(&KeyValue{Key: key, Val: []byte("some value")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[string(key)] = true
+	}
+	err = pager.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshotSize := pager.DBSize()
+	snapshot, err := pager.BeginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := snapshot.OpenBTree(tree.Root)
+	for i := 0; i < 500; i += 2 {
+		_, err = tree.Delete([]byte(fmt.Sprintf("key%06d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = pager.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The snapshot still sees every key, since none of its pages were changed
+	checkTree(t, old, expected)
+	if err = old.Insert(&KeyValue{Key: []byte("a")}); err != errReadOnlyTree {
+		t.Fatalf("Expected errReadOnlyTree, got %v", err)
+	}
+	// Only the freelist's trunk page, which the snapshot can't see, is free
+	for _, ID := range pager.free {
+		if ID <= snapshotSize {
+			t.Fatal("Pages that the snapshot can see were reused")
+		}
+	}
+
+	numFree := len(pager.free)
+	snapshot.Close()
+	if len(pager.free) == numFree {
+		t.Fatal("Expected the pages of the old version to be free")
+	}
+	// New pages come from the free list, instead of the end of the file
+	size := pager.DBSize()
+	for i := 0; i < 500; i += 2 {
+		err = tree.Insert(&KeyValue{Key: []byte(fmt.Sprintf("key%06d", i)), Val: []byte("some value")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = pager.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pager.DBSize() >= 2*size {
+		t.Fatalf("Expected freed pages to be reused, the DB grew from %d to %d pages", size, pager.DBSize())
+	}
+	checkTree(t, tree, expected)
+}
@@ -1,18 +1,26 @@
 package app
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
 	"github.com/thomastay/rash-db/pkg/disk"
-	"github.com/vmihailenco/msgpack/v5"
 )
 
 // Represents a table's columns, so we know what data goes into them.
-// These are encoded into arrays and serialized as messagepack objects for simplicity
+// These are encoded into arrays and serialized as JSON in the schema table, for simplicity
 type TableSchema struct {
 	Name       string
 	Root       int
 	PrimaryKey []TableColumn
 	// Note: These columns don't contain the primary key(s)
+	// Columns are in the order they are stored in, so dropped columns stay here until the table is compacted.
 	Columns []TableColumn
+	// Goes up by one every time the columns change
+	Version int
+	// The largest ID that the autoincrementing key has had, so that IDs are never handed out twice
+	Sequence int64
 }
 
 func (m *TableSchema) EncodeAsSchemaRow() TableKeyValue {
@@ -24,6 +32,10 @@ func (m *TableSchema) EncodeAsSchemaRow() TableKeyValue {
 			"primary_key": m.PrimaryKey,
 			"columns":     m.Columns,
 			"root":        m.Root,
+			"type":        schemaTypeTable,
+			"table":       m.Name,
+			"version":     m.Version,
+			"sequence":    m.Sequence,
 		},
 	}
 }
@@ -31,99 +43,365 @@ func (m *TableSchema) EncodeAsSchemaRow() TableKeyValue {
 type TableColumn struct {
 	Key   string
 	Value DataType
+	// No two rows may have the same value in this column. This is enforced by a unique index on the column
+	Unique bool
+	// The column may not be NULL
+	NotNull bool
+	// The column was dropped, but rows still have a (NULL) value for it until the table is compacted
+	Dropped bool
+	// Rows that are inserted without a value for this column get the next ID of the table's sequence.
+	// Only an integer primary key that is the whole primary key can autoincrement
+	AutoIncrement bool
 }
 
-var _ msgpack.CustomEncoder = (*TableColumn)(nil)
+// The columns that haven't been dropped
+func (m *TableSchema) LiveColumns() []TableColumn {
+	cols := make([]TableColumn, 0, len(m.Columns))
+	for _, col := range m.Columns {
+		if !col.Dropped {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
 
-func (c *TableColumn) EncodeMsgpack(enc *msgpack.Encoder) error {
-	enc.EncodeArrayLen(2)
-	err := enc.EncodeString(c.Key)
-	if err != nil {
-		return err
+// The primary key column that autoincrements, or nil if the table doesn't have one
+func (m *TableSchema) AutoIncrementKey() *TableColumn {
+	for i := range m.PrimaryKey {
+		if m.PrimaryKey[i].AutoIncrement {
+			return &m.PrimaryKey[i]
+		}
+	}
+	return nil
+}
+
+// The flags of a column are stored as a bitset, after its name and type
+const (
+	columnUnique = 1 << iota
+	columnNotNull
+	columnDropped
+	columnAutoIncrement
+)
+
+func (c *TableColumn) flags() uint64 {
+	var flags uint64
+	if c.Unique {
+		flags |= columnUnique
 	}
-	return enc.EncodeUint(uint64(c.Value))
+	if c.NotNull {
+		flags |= columnNotNull
+	}
+	if c.Dropped {
+		flags |= columnDropped
+	}
+	if c.AutoIncrement {
+		flags |= columnAutoIncrement
+	}
+	return flags
+}
+
+func (c *TableColumn) setFlags(flags uint64) {
+	c.Unique = flags&columnUnique != 0
+	c.NotNull = flags&columnNotNull != 0
+	c.Dropped = flags&columnDropped != 0
+	c.AutoIncrement = flags&columnAutoIncrement != 0
+}
+
+var _ json.Marshaler = (*TableColumn)(nil)
+
+// Columns are stored in the schema table as JSON arrays of their name, type and flags
+func (c TableColumn) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{c.Key, c.Value, c.flags()})
 }
 
-var _ msgpack.CustomDecoder = (*TableColumn)(nil)
+var _ json.Unmarshaler = (*TableColumn)(nil)
 
-func (c *TableColumn) DecodeMsgpack(dec *msgpack.Decoder) error {
-	k, err := dec.DecodeString()
+func (c *TableColumn) UnmarshalJSON(b []byte) error {
+	var tuple []json.RawMessage
+	err := json.Unmarshal(b, &tuple)
 	if err != nil {
 		return err
 	}
-	c.Key = k
-	v, err := dec.DecodeUint()
+	// Older columns don't have flags
+	if len(tuple) != 2 && len(tuple) != 3 {
+		return fmt.Errorf("Invalid TableColumn tuple of length %d", len(tuple))
+	}
+	err = json.Unmarshal(tuple[0], &c.Key)
 	if err != nil {
 		return err
 	}
-	c.Value = DataType(v)
+	err = json.Unmarshal(tuple[1], &c.Value)
+	if err != nil {
+		return err
+	}
+	var flags uint64
+	if len(tuple) == 3 {
+		err = json.Unmarshal(tuple[2], &flags)
+		if err != nil {
+			return err
+		}
+	}
+	c.setFlags(flags)
 	return nil
 }
 
 // This is the "header" of the schema table
-// The rows of the schema table are the schemas of the tables themselves.
+// The rows of the schema table are the schemas of the tables themselves, and of their indexes.
+// Tables and indexes share the same names, so a table and an index can't have the same name.
 // The schema table is always at page 1
 // This schema is an implementation detail and should not be exposed to consumers
 var schemaTable = TableSchema{
 	Name: "rashdb_schema",
 	PrimaryKey: []TableColumn{
-		{"name", DBStr},
+		{Key: "name", Value: DBStr},
 	},
 	Columns: []TableColumn{
-		{"root", DBInt}, // root page ID
-		{"primary_key", DBJsonArr},
-		{"columns", DBJsonArr},
+		{Key: "root", Value: DBInt}, // root page ID
+		{Key: "primary_key", Value: DBJsonArr},
+		{Key: "columns", Value: DBJsonArr},
+		{Key: "type", Value: DBStr},  // schemaTypeTable or schemaTypeIndex
+		{Key: "table", Value: DBStr}, // the table that an index is on. For tables, the table itself
+		// The schema version of a table. Rows written before this column existed read it as NULL
+		{Key: "version", Value: DBInt},
+		// The sequence of a table's autoincrementing key. Also NULL in older rows
+		{Key: "sequence", Value: DBInt},
 	},
 }
 
-const DBSchemaPageID = 1
+// Returned when a row of the schema table can't be decoded, which means that the DB file is corrupt
+var ErrCorruptSchema = errors.New("schema: invalid schema row")
 
-func NewSchemaPage(schemas []*TableSchema, pageSize int, pager *Pager, dbHeaders *disk.Header) *LeafNode {
-	rows := make([]TableKeyValue, len(schemas))
-	for i, schema := range schemas {
-		rows[i] = schema.EncodeAsSchemaRow()
-	}
+// The types of rows in the schema table
+const (
+	schemaTypeTable = "table"
+	schemaTypeIndex = "index"
+)
 
-	return &LeafNode{
+const DBSchemaPageID = 1
+
+// Creates the schema table of a new database, as an empty B-tree rooted at page 1
+func CreateSchemaTree(pager *Pager, dbHeaders *disk.Header) (*BTree, error) {
+	t := NewBTree(DBSchemaPageID, pager)
+	root := LeafNode{
 		ID:        DBSchemaPageID,
-		PageSize:  pageSize,
-		Data:      rows,
-		Headers:   &schemaTable,
-		Pager:     pager,
+		PageSize:  pager.PageSize,
 		DBHeaders: dbHeaders,
 	}
+	err := t.writeNode(&root)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Opens the schema table of an existing database
+func OpenSchemaTree(pager *Pager) *BTree {
+	return NewBTree(DBSchemaPageID, pager)
+}
+
+// Writes the schema of a table into the schema table, replacing the old schema if there is one
+func PutSchema(schemaTree *BTree, schema *TableSchema) error {
+	row := schema.EncodeAsSchemaRow()
+	kv, err := EncodeKeyValue(&schemaTable, &row)
+	if err != nil {
+		return err
+	}
+	return schemaTree.Upsert(kv)
+}
+
+// Writes the schema of an index into the schema table, replacing the old schema if there is one
+func PutIndex(schemaTree *BTree, index *IndexSchema) error {
+	row := index.EncodeAsSchemaRow()
+	kv, err := EncodeKeyValue(&schemaTable, &row)
+	if err != nil {
+		return err
+	}
+	return schemaTree.Upsert(kv)
 }
 
-func DecodeSchemaPage(page *disk.LeafPage) ([]TableSchema, error) {
-	kvs, err := DecodeKeyValuesOnPage(&schemaTable, page)
+// Deletes the schema of a table or an index. Returns false if there is no such schema.
+func DeleteSchema(schemaTree *BTree, name string) (bool, error) {
+	key, err := EncodeKey(&schemaTable, map[string]interface{}{"name": name})
+	if err != nil {
+		return false, err
+	}
+	return schemaTree.Delete(key)
+}
+
+// Looks up the row of the schema table with the given name. Returns nil if there is no such row.
+func getSchemaRow(schemaTree *BTree, name string) (*TableKeyValue, error) {
+	key, err := EncodeKey(&schemaTable, map[string]interface{}{"name": name})
+	if err != nil {
+		return nil, err
+	}
+	val, found, err := schemaTree.Get(key)
+	if err != nil || !found {
+		return nil, err
+	}
+	row, err := DecodeKeyValue(&schemaTable, &KeyValue{Key: key, Val: val})
 	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrCorruptSchema, name, err)
+	}
+	return row, nil
+}
+
+// Looks up the schema of a table by name. Returns nil if there is no such table.
+func GetSchema(schemaTree *BTree, name string) (*TableSchema, error) {
+	row, err := getSchemaRow(schemaTree, name)
+	if err != nil || row == nil || row.Val["type"] != schemaTypeTable {
+		return nil, err
+	}
+	return decodeTableSchema(row)
+}
+
+// Looks up the schema of an index by name. Returns nil if there is no such index.
+func GetIndex(schemaTree *BTree, name string) (*IndexSchema, error) {
+	row, err := getSchemaRow(schemaTree, name)
+	if err != nil || row == nil || row.Val["type"] != schemaTypeIndex {
 		return nil, err
 	}
-	tables := make([]TableSchema, len(kvs))
-	for i, kv := range kvs {
-		tables[i].Name = kv.Key["name"].(string)
-		tables[i].Root = int(kv.Val["root"].(int64))
-		tables[i].PrimaryKey = toTableColumns(kv.Val["primary_key"])
-		tables[i].Columns = toTableColumns(kv.Val["columns"])
+	return decodeIndexSchema(row)
+}
+
+// Whether there is a table or an index with the given name
+func SchemaNameExists(schemaTree *BTree, name string) (bool, error) {
+	row, err := getSchemaRow(schemaTree, name)
+	return row != nil, err
+}
+
+// Reads the schemas of every table, ordered by name
+func ListSchemas(schemaTree *BTree) ([]TableSchema, error) {
+	tables := make([]TableSchema, 0)
+	err := forEachSchemaRow(schemaTree, func(row *TableKeyValue) error {
+		if row.Val["type"] != schemaTypeTable {
+			return nil
+		}
+		schema, err := decodeTableSchema(row)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, *schema)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return tables, nil
 }
 
-func toTableColumns(encoded interface{}) []TableColumn {
-	// It's encoded as an array of arrays
-	arrInterface := encoded.([]interface{})
-	result := make([]TableColumn, len(arrInterface))
-	for i, i1 := range arrInterface {
-		i2 := i1.([]interface{})
-		if len(i2) != 2 {
-			panic("Invalid TableColumn pair")
+// Reads the schemas of every index on a table, ordered by name
+func ListIndexes(schemaTree *BTree, table string) ([]IndexSchema, error) {
+	indexes := make([]IndexSchema, 0)
+	err := forEachSchemaRow(schemaTree, func(row *TableKeyValue) error {
+		if row.Val["type"] != schemaTypeIndex || row.Val["table"] != table {
+			return nil
+		}
+		idx, err := decodeIndexSchema(row)
+		if err != nil {
+			return err
+		}
+		indexes = append(indexes, *idx)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return indexes, nil
+}
+
+func forEachSchemaRow(schemaTree *BTree, fn func(row *TableKeyValue) error) error {
+	return schemaTree.ForEach(func(kv *KeyValue) error {
+		row, err := DecodeKeyValue(&schemaTable, kv)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrCorruptSchema, err)
 		}
-		key := i2[0].(string)
-		val := i2[1].(uint64)
-		result[i].Key = key
-		result[i].Value = DataType(val)
+		return fn(row)
+	})
+}
+
+// The columns that every schema row has. Returns ErrCorruptSchema if they have the wrong types
+func decodeSchemaRow(row *TableKeyValue) (name string, root int, err error) {
+	name, ok := row.Key["name"].(string)
+	if !ok {
+		return "", 0, fmt.Errorf("%w: name is %T", ErrCorruptSchema, row.Key["name"])
+	}
+	rootID, ok := row.Val["root"].(int64)
+	if !ok || rootID < 0 {
+		return "", 0, fmt.Errorf("%w: %s: invalid root %v", ErrCorruptSchema, name, row.Val["root"])
+	}
+	return name, int(rootID), nil
+}
+
+func decodeTableSchema(row *TableKeyValue) (*TableSchema, error) {
+	name, root, err := decodeSchemaRow(row)
+	if err != nil {
+		return nil, err
+	}
+	primaryKey, err := toTableColumns(name, row.Val["primary_key"])
+	if err != nil {
+		return nil, err
+	}
+	columns, err := toTableColumns(name, row.Val["columns"])
+	if err != nil {
+		return nil, err
+	}
+	version, _ := row.Val["version"].(int64)
+	sequence, _ := row.Val["sequence"].(int64)
+	return &TableSchema{
+		Name:       name,
+		Root:       root,
+		PrimaryKey: primaryKey,
+		Columns:    columns,
+		Version:    int(version),
+		Sequence:   sequence,
+	}, nil
+}
+
+func decodeIndexSchema(row *TableKeyValue) (*IndexSchema, error) {
+	name, root, err := decodeSchemaRow(row)
+	if err != nil {
+		return nil, err
+	}
+	table, ok := row.Val["table"].(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s: table is %T", ErrCorruptSchema, name, row.Val["table"])
+	}
+	columns, err := toTableColumns(name, row.Val["columns"])
+	if err != nil {
+		return nil, err
+	}
+	idx := IndexSchema{
+		Name:    name,
+		Table:   table,
+		Root:    root,
+		Columns: columns,
+	}
+	idx.Unique = len(idx.Columns) > 0
+	for _, col := range idx.Columns {
+		idx.Unique = idx.Unique && col.Unique
+	}
+	return &idx, nil
+}
+
+// Decodes the columns of the schema row called name
+func toTableColumns(name string, encoded interface{}) ([]TableColumn, error) {
+	// It's stored as a JSON array of columns, or NULL if there are no columns
+	if encoded == nil {
+		return []TableColumn{}, nil
+	}
+	raw, ok := encoded.(json.RawMessage)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s: columns are %T", ErrCorruptSchema, name, encoded)
+	}
+	var result []TableColumn
+	err := json.Unmarshal(raw, &result)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrCorruptSchema, name, err)
+	}
+	if result == nil {
+		result = []TableColumn{}
 	}
-	return result
+	return result, nil
 }
 
 //go:generate stringer -type=DataType
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/thomastay/rash-db/pkg/disk"
+)
+
+func TestSchemaTreeStaysOnFirstPage(t *testing.T) {
+	pager := newTestPager(t, 512)
+	header := disk.Header{PageSize: 512}
+	tree, err := CreateSchemaTree(pager, &header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]bool)
+	for i := 0; i < 300; i++ {
+		schema := TableSchema{
+			Name:       fmt.Sprintf("table%04d", i),
+			Root:       i + 1000,
+			PrimaryKey: []TableColumn{{Key: "id", Value: DBInt}},
+			Columns:    []TableColumn{{Key: "name", Value: DBStr, Unique: true}, {Key: "data", Value: DBBlob, NotNull: true}},
+		}
+		err = PutSchema(tree, &schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := EncodeKey(&schemaTable, map[string]interface{}{"name": schema.Name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[string(key)] = true
+	}
+	if tree.Root != DBSchemaPageID {
+		t.Fatalf("The schema table moved to page %d", tree.Root)
+	}
+	// Replacing a schema doesn't add a row
+	err = PutSchema(tree, &TableSchema{
+		Name:       "table0042",
+		Root:       7,
+		PrimaryKey: []TableColumn{{Key: "id", Value: DBInt, NotNull: true, AutoIncrement: true}},
+		Version:    3,
+		Sequence:   12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pager.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, tree, expected)
+
+	info, err := pager.Request(DBSchemaPageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, ok := info.Page.(*disk.InteriorPage)
+	info.Done()
+	if !ok || root.DBHeader == nil || root.DBHeader.NumPages != uint32(pager.DBSize()) {
+		t.Fatal("Expected the first page to be an interior page, holding the DB header")
+	}
+	schema, err := GetSchema(tree, "table0042")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema == nil || schema.Root != 7 || schema.Version != 3 || schema.Sequence != 12 {
+		t.Fatalf("Expected the replaced schema, got %+v", schema)
+	}
+	if key := schema.AutoIncrementKey(); key == nil || key.Key != "id" || !key.NotNull {
+		t.Fatalf("Expected the id column to autoincrement, got %+v", schema.PrimaryKey)
+	}
+	schema, err = GetSchema(tree, "table0043")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !schema.Columns[0].Unique || schema.Columns[1].Unique {
+		t.Fatalf("Expected only the name column to be unique, got %+v", schema.Columns)
+	}
+	if schema.Columns[0].NotNull || !schema.Columns[1].NotNull {
+		t.Fatalf("Expected only the data column to be not null, got %+v", schema.Columns)
+	}
+
+	// Shrinks back to a single leaf on the first page
+	for key := range expected {
+		if key == string(mustEncodeName(t, "table0001")) {
+			continue
+		}
+		_, err = tree.Delete([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, key)
+	}
+	checkTree(t, tree, expected)
+	leaf, _, err := tree.readNode(DBSchemaPageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf == nil || leaf.DBHeaders == nil {
+		t.Fatal("Expected the first page to be a leaf, holding the DB header")
+	}
+	schemas, err := ListSchemas(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schemas) != 1 || schemas[0].Name != "table0001" || schemas[0].Root != 1001 {
+		t.Fatalf("Unexpected schemas %+v", schemas)
+	}
+}
+
+func mustEncodeName(t *testing.T, name string) []byte {
+	key, err := EncodeKey(&schemaTable, map[string]interface{}{"name": name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestCorruptSchema(t *testing.T) {
+	pager := newTestPager(t, 512)
+	header := disk.Header{PageSize: 512}
+	tree, err := CreateSchemaTree(pager, &header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := map[string]map[string]interface{}{
+		"bad_columns": {"root": 2, "type": schemaTypeTable, "columns": json.RawMessage("{not json")},
+		"bad_key":     {"root": 3, "type": schemaTypeTable, "primary_key": "id"},
+		"bad_root":    {"root": "two", "type": schemaTypeTable},
+		"bad_index":   {"root": 4, "type": schemaTypeIndex, "table": 5},
+	}
+	for name, vals := range rows {
+		kv, err := EncodeKeyValue(&schemaTable, &TableKeyValue{Key: map[string]interface{}{"name": name}, Val: vals})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tree.Insert(kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"bad_columns", "bad_key", "bad_root"} {
+		_, err = GetSchema(tree, name)
+		if !errors.Is(err, ErrCorruptSchema) {
+			t.Fatalf("Expected ErrCorruptSchema for %s, got %v", name, err)
+		}
+	}
+	_, err = GetIndex(tree, "bad_index")
+	if !errors.Is(err, ErrCorruptSchema) {
+		t.Fatalf("Expected ErrCorruptSchema, got %v", err)
+	}
+	_, err = ListSchemas(tree)
+	if !errors.Is(err, ErrCorruptSchema) {
+		t.Fatalf("Expected ErrCorruptSchema, got %v", err)
+	}
+}
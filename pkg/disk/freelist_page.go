@@ -0,0 +1,87 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/thomastay/rash-db/pkg/common"
+)
+
+// Represents a Freelist trunk page. The free pages of the DB are listed on a linked list of trunk pages,
+// starting from the trunk page in the DB header. The trunk pages are free pages too.
+//
+// ```
+// (Header - fixed 8 bytes)
+// +-----+
+// + 0x4 + (Freelist trunk)		(one byte)
+// +-----+
+// +--------------------------+
+// + Next trunk page ID       +  (four bytes, 0 if this is the last trunk page)
+// +--------------------------+
+// +-------------------------------+
+// + Number of free page IDs (n)   +  (two bytes)
+// +-------------------------------+
+// +----------+
+// + Reserved +          		(one byte)
+// +----------+
+//
+// (Free page IDs - four bytes each. There are n IDs)
+// +-----------+-----------+
+// + Page ID 1 + Page ID 2 + ...
+// +-----------+-----------+
+// ```
+type FreelistPage struct {
+	Next    uint32
+	PageIDs []uint32
+}
+
+func (p *FreelistPage) MarshalBinary(pageSize int) ([]byte, error) {
+	if len(p.PageIDs) > FreelistPageCapacity(pageSize) {
+		panic("Freelist page IDs must fit onto page size")
+	}
+	buf := NewFixedBytesBuffer(make([]byte, pageSize))
+
+	// ---- Write headers ---
+	common.Check(buf.WriteByte(HeaderFreelistPage))
+	common.Check(binary.Write(buf, dbEndianness, p.Next))
+	common.Check(binary.Write(buf, dbEndianness, uint16(len(p.PageIDs))))
+	buf.Skip(freelistPageHeaderReservedSize) // reserved bytes
+	// ---- End headers ---
+
+	err := binary.Write(buf, dbEndianness, p.PageIDs)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeFreelistPage(pb *bytes.Buffer, pageSize int) (*FreelistPage, error) {
+	p := FreelistPage{}
+	err := binary.Read(pb, dbEndianness, &p.Next)
+	if err != nil {
+		return nil, err
+	}
+	numIDs, err := common.ReadUint16(pb)
+	if err != nil {
+		return nil, err
+	}
+	if int(numIDs) > FreelistPageCapacity(pageSize) {
+		return nil, errPageCorruption("too many free page IDs", FreelistPageCapacity(pageSize), uint64(numIDs))
+	}
+	_ = pb.Next(freelistPageHeaderReservedSize) // skip forward
+	// ---- End reading header ----
+
+	p.PageIDs = make([]uint32, numIDs)
+	err = binary.Read(pb, dbEndianness, p.PageIDs)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// The number of free page IDs that fit onto a single trunk page
+func FreelistPageCapacity(pageSize int) int {
+	return (pageSize - pageHeaderSize) / 4
+}
+
+const freelistPageHeaderReservedSize = 1
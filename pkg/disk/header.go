@@ -18,11 +18,21 @@ type Header struct {
 	Version  uint32
 	PageSize uint16
 	NumPages uint32
+	// The first freelist trunk page, or 0 if there are no free pages
+	FreelistTrunk uint32
+	// The number of free pages, including the trunk pages
+	FreelistCount uint32
 }
 
 const DBHeaderSize = 128
 const DefaultDBPageSize = 4096
 
+// The smallest page size that a DB can have
+const MinDBPageSize = 512
+
+// The version of the file format. Files with any other version can't be read.
+const DBVersion = 2
+
 var MagicHeader = [16]byte{
 	'r', 'a', 's', 'h', 'd', 'b', ' ',
 	'f', 'o', 'r', 'm', 'a', 't', ' ',
@@ -42,11 +52,13 @@ func (header *Header) MarshalBinary() (data []byte, err error) {
 	}
 	common.Check(binary.Write(b, dbEndianness, header.Version))
 	if header.PageSize == 0 {
-		common.Check(binary.Write(b, dbEndianness, DefaultDBPageSize))
+		common.Check(binary.Write(b, dbEndianness, uint16(DefaultDBPageSize)))
 	} else {
 		common.Check(binary.Write(b, dbEndianness, header.PageSize))
 	}
 	common.Check(binary.Write(b, dbEndianness, header.NumPages))
+	common.Check(binary.Write(b, dbEndianness, header.FreelistTrunk))
+	common.Check(binary.Write(b, dbEndianness, header.FreelistCount))
 
 	return b.Bytes(), nil
 }
@@ -0,0 +1,157 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/thomastay/rash-db/pkg/common"
+)
+
+// Represents an Interior page of a B-tree
+//
+// ```
+// (Header - fixed 8 bytes)
+// +-----+
+// + 0x2 + (Interior)    		(one byte)
+// +-----+
+// +---------------------+
+// + Number of cells (n) +  (two bytes)
+// +---------------------+
+// +---------------------+
+// + Right child page ID +  (four bytes)
+// +---------------------+
+// +----------+
+// + Reserved +          		(one byte)
+// +----------+
+//
+// (Cell pointer area - all indexes are 2 bytes. There are n pointers)
+// (pointers point to the END of the cell, same as the leaf page)
+// +-------+-------+-------+
+// + cell1 + cell2 + cell3 + ...
+// +-------+-------+-------+
+//
+// (Cell area - equals signs means variable length fields)
+// +----------------+=======+----------------+=======+
+// + Left child ID1 + Key 1 + Left child ID2 + Key 2 + ...
+// +----------------+=======+----------------+=======+
+//
+// (Free space)
+// ```
+//
+// Every key in the subtree rooted at Left child i is strictly less than Key i.
+// Every key greater than or equal to the last key lives under the right child.
+type InteriorPage struct {
+	// Header     byte  // Not actually stored in memory, but represented in the struct
+	NumCells   uint16
+	RightChild uint32
+	// reserved (1 byte - not used for now)
+	Pointers []uint16
+	Cells    []InteriorCell
+
+	// only for page #1. Nil for any other page
+	DBHeader *Header
+}
+
+type InteriorCell struct {
+	LeftChild uint32
+	Key       Cell
+}
+
+// The number of bytes the cell takes up on a page
+func (c *InteriorCell) Size() int {
+	return 4 + c.Key.Size()
+}
+
+func (p *InteriorPage) MarshalBinary(pageSize int) ([]byte, error) {
+	var err error
+	buf := NewFixedBytesBuffer(make([]byte, pageSize))
+	if p.DBHeader != nil {
+		// should only be for the very first page
+		headerBytes, err := p.DBHeader.MarshalBinary()
+		common.Check(err)
+		buf.Write(headerBytes)
+	}
+
+	// ---- Write headers ---
+	common.Check(buf.WriteByte(HeaderInteriorPage))
+	common.Check(binary.Write(buf, dbEndianness, p.NumCells))
+	common.Check(binary.Write(buf, dbEndianness, p.RightChild))
+	buf.Skip(interiorPageHeaderReservedSize) // reserved bytes
+	// ---- End headers ---
+
+	for _, ptr := range p.Pointers {
+		err = binary.Write(buf, dbEndianness, ptr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, cell := range p.Cells {
+		err = binary.Write(buf, dbEndianness, cell.LeftChild)
+		if err != nil {
+			return nil, err
+		}
+		err = writeCell(buf, cell.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeInteriorPage(pb *bytes.Buffer, pageSize int, isRootPage bool) (*InteriorPage, error) {
+	p := InteriorPage{}
+	noofCells16, err := common.ReadUint16(pb)
+	if err != nil {
+		return nil, err
+	}
+	if noofCells16 > maxNumCellsPerPage(pageSize) {
+		return nil, errPageCorruption("too many keys", int(maxNumCellsPerPage(pageSize)), uint64(noofCells16))
+	}
+	p.NumCells = noofCells16
+	numCells := int(noofCells16) // convenience
+
+	err = binary.Read(pb, dbEndianness, &p.RightChild)
+	if err != nil {
+		return nil, err
+	}
+	if p.RightChild == 0 {
+		return nil, errPageCorruption("interior pages must have a right child", 1, 0)
+	}
+	_ = pb.Next(interiorPageHeaderReservedSize) // skip forward
+	// ---- End reading header ----
+
+	p.Pointers, err = readPointers(pb, numCells, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	p.Cells = make([]InteriorCell, numCells)
+
+	start := pageHeaderSize + 2*numCells
+	if isRootPage {
+		start += DBHeaderSize
+	}
+	for i := 0; i < len(p.Pointers); i++ {
+		var cellSize int
+		if i == 0 {
+			cellSize = int(p.Pointers[i]) - start
+		} else {
+			prev, curr := p.Pointers[i-1], p.Pointers[i]
+			cellSize = int(curr) - int(prev)
+		}
+		cell := InteriorCell{}
+		err = binary.Read(pb, dbEndianness, &cell.LeftChild)
+		if err != nil {
+			return nil, err
+		}
+		cell.Key, err = readCell(pb, cellSize-4)
+		if err != nil {
+			return nil, err
+		}
+		p.Cells[i] = cell
+	}
+
+	return &p, nil
+}
+
+const interiorPageHeaderReservedSize = 1
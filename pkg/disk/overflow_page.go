@@ -0,0 +1,86 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/thomastay/rash-db/pkg/common"
+)
+
+// Represents an Overflow page. Payloads which are too big to fit on a B-tree page store the
+// first part of the payload on the page, and the rest in a linked list of overflow pages.
+//
+// ```
+// (Header - fixed 8 bytes)
+// +-----+
+// + 0x3 + (Overflow)    		(one byte)
+// +-----+
+// +--------------------------+
+// + Next overflow page ID    +  (four bytes, 0 if this is the last page)
+// +--------------------------+
+// +-------------------------+
+// + Number of payload bytes +  (two bytes)
+// +-------------------------+
+// +----------+
+// + Reserved +          		(one byte)
+// +----------+
+//
+// (Payload - the rest of the page)
+// +=========+
+// + Payload +
+// +=========+
+// ```
+type OverflowPage struct {
+	Next    uint32
+	Payload []byte
+}
+
+func (p *OverflowPage) MarshalBinary(pageSize int) ([]byte, error) {
+	if len(p.Payload) > OverflowPageCapacity(pageSize) {
+		panic("Overflow page payload must fit onto page size")
+	}
+	buf := NewFixedBytesBuffer(make([]byte, pageSize))
+
+	// ---- Write headers ---
+	common.Check(buf.WriteByte(HeaderOverflowPage))
+	common.Check(binary.Write(buf, dbEndianness, p.Next))
+	common.Check(binary.Write(buf, dbEndianness, uint16(len(p.Payload))))
+	buf.Skip(overflowPageHeaderReservedSize) // reserved bytes
+	// ---- End headers ---
+
+	err := common.WriteExactly(buf, p.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeOverflowPage(pb *bytes.Buffer, pageSize int) (*OverflowPage, error) {
+	p := OverflowPage{}
+	err := binary.Read(pb, dbEndianness, &p.Next)
+	if err != nil {
+		return nil, err
+	}
+	payloadLen, err := common.ReadUint16(pb)
+	if err != nil {
+		return nil, err
+	}
+	if int(payloadLen) > OverflowPageCapacity(pageSize) {
+		return nil, errPageCorruption("overflow payload too large", OverflowPageCapacity(pageSize), uint64(payloadLen))
+	}
+	_ = pb.Next(overflowPageHeaderReservedSize) // skip forward
+	// ---- End reading header ----
+
+	p.Payload, err = common.ReadExactly(pb, int(payloadLen))
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// The number of payload bytes that fit onto a single overflow page
+func OverflowPageCapacity(pageSize int) int {
+	return pageSize - pageHeaderSize
+}
+
+const overflowPageHeaderReservedSize = 1
@@ -4,12 +4,18 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 
 	"github.com/thomastay/rash-db/pkg/common"
 	"github.com/thomastay/rash-db/pkg/varint"
 )
 
+// A page as it is laid out on disk. Every page type knows how to serialize itself into exactly one page.
+type Page interface {
+	MarshalBinary(pageSize int) ([]byte, error)
+}
+
 // Represents a Leaf page
 //
 // ```
@@ -72,20 +78,10 @@ func (p *LeafPage) MarshalBinary(pageSize int) ([]byte, error) {
 	}
 
 	for _, cell := range p.Cells {
-		err = common.WriteExactly(buf, varint.Encode64(cell.PayloadLen))
-		if err != nil {
-			return nil, err
-		}
-		err = common.WriteExactly(buf, cell.PayloadInitial)
+		err = writeCell(buf, cell)
 		if err != nil {
 			return nil, err
 		}
-		if cell.OffsetPageID != 0 {
-			err = binary.Write(buf, dbEndianness, cell.OffsetPageID)
-			if err != nil {
-				return nil, err
-			}
-		}
 	}
 
 	result := buf.Bytes()
@@ -95,24 +91,56 @@ func (p *LeafPage) MarshalBinary(pageSize int) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func Decode(pageBytes []byte, pageSize int, pageID int) (*LeafPage, error) {
+// Decodes a page of any type. The caller can type switch on the result to find out which page it is.
+func Decode(pageBytes []byte, pageSize int, pageID int) (Page, error) {
 	if len(pageBytes) != pageSize {
 		panic("Page size and page bytes don't match. This is an application level error")
 	}
 	pb := bytes.NewBuffer(pageBytes)
 	isRootPage := pageID == 1
+	var header *Header
 	if isRootPage {
-		// header, skip
-		_ = pb.Next(DBHeaderSize)
+		header = &Header{}
+		err := header.UnmarshalBinary(pb.Next(DBHeaderSize))
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	pageType, err := pb.ReadByte()
 	common.Check(err)
 
-	if pageType != HeaderLeafPage {
+	switch pageType {
+	case HeaderLeafPage:
+		p, err := decodeLeafPage(pb, pageSize, isRootPage)
+		if err != nil {
+			return nil, err
+		}
+		p.DBHeader = header
+		return p, nil
+	case HeaderInteriorPage:
+		p, err := decodeInteriorPage(pb, pageSize, isRootPage)
+		if err != nil {
+			return nil, err
+		}
+		p.DBHeader = header
+		return p, nil
+	case HeaderOverflowPage:
+		if isRootPage {
+			return nil, errPageCorruption("the first page cannot be an overflow page", HeaderLeafPage, uint64(pageType))
+		}
+		return decodeOverflowPage(pb, pageSize)
+	case HeaderFreelistPage:
+		if isRootPage {
+			return nil, errPageCorruption("the first page cannot be a freelist page", HeaderLeafPage, uint64(pageType))
+		}
+		return decodeFreelistPage(pb, pageSize)
+	default:
 		return nil, fmt.Errorf("Wrong header value %d", pageType)
-		// TODO other types of pages?
 	}
+}
+
+func decodeLeafPage(pb *bytes.Buffer, pageSize int, isRootPage bool) (*LeafPage, error) {
 	p := LeafPage{}
 	noofCells16, err := common.ReadUint16(pb)
 	if err != nil {
@@ -127,70 +155,28 @@ func Decode(pageBytes []byte, pageSize int, pageID int) (*LeafPage, error) {
 	_ = pb.Next(pageHeaderReservedSize) // skip forward
 	// ---- End reading header ----
 
-	p.Pointers = make([]uint16, numCells)
+	p.Pointers, err = readPointers(pb, numCells, pageSize)
+	if err != nil {
+		return nil, err
+	}
 	p.Cells = make([]Cell, numCells)
 
-	var prev uint16
-	for i := 0; i < len(p.Pointers); i++ {
-		ptr, err := common.ReadUint16(pb)
-		if err != nil {
-			return nil, err
-		}
-		if i > 0 && ptr < prev {
-			// pointers can be the same as the previous, if the cell length is zero
-			return nil, errPageCorruption("Pointers should be non-decreasing", int(prev), uint64(ptr))
-		}
-		if int(ptr) >= pageSize {
-			return nil, errPageCorruption("Pointers should be within the page size", pageSize, uint64(ptr))
-		}
-		prev = ptr
-		p.Pointers[i] = ptr
+	start := pageHeaderSize + 2*numCells
+	if isRootPage {
+		start += DBHeaderSize
 	}
-
 	for i := 0; i < len(p.Pointers); i++ {
 		var cellSize int
 		if i == 0 {
-			prev := pageHeaderSize + 2*int(p.NumCells)
-			if isRootPage {
-				prev += DBHeaderSize
-			}
-			cellSize = int(p.Pointers[i]) - prev
+			cellSize = int(p.Pointers[i]) - start
 		} else {
 			prev, curr := p.Pointers[i-1], p.Pointers[i]
 			cellSize = int(curr) - int(prev)
 		}
+		cell, err := readCell(pb, cellSize)
 		if err != nil {
 			return nil, err
 		}
-		cell := Cell{}
-
-		payloadLen, err := varint.Decode(pb)
-		if err != nil {
-			return nil, err
-		}
-		cell.PayloadLen = payloadLen
-		numBytesPayloadLen := varint.NumBytesNeededToEncode(payloadLen)
-		// If there is no overflow, the payload len will be much larger than the cell size
-		// Be careful! payloadLen could be MAX_INT64
-		// Malicious actors / idiot programmer (aka me) could encode a really large payload len, we have to handle it properly
-		hasOverflow := uint64(cellSize)-uint64(numBytesPayloadLen) < payloadLen
-		if hasOverflow {
-			panic("Overflow pages not implemented yet")
-		}
-
-		// Check for page corruption.
-		// Don't cast to int here, which will silently truncate and cause all sorts of weird issues
-		if payloadLen != uint64(cellSize)-uint64(numBytesPayloadLen) {
-			return nil, errPageCorruption("mismatch of pointer length and cell's own length", cellSize-numBytesPayloadLen, payloadLen)
-		}
-
-		// If there is no corruption and no overflow, payloadLen must fit within a 32 bit int. But let's check just to be safe.
-		pLen := common.CheckNoOverflow(payloadLen)
-		payload, err := common.ReadExactly(pb, pLen)
-		if err != nil {
-			return nil, err
-		}
-		cell.PayloadInitial = payload
 		p.Cells[i] = cell
 	}
 
@@ -206,8 +192,100 @@ type Cell struct {
 	OffsetPageID   uint32 // if there is no offset, represented as 0 and not written to disk.
 }
 
+// The number of bytes the cell takes up on a page
+func (c *Cell) Size() int {
+	size := varint.NumBytesNeededToEncode(c.PayloadLen) + len(c.PayloadInitial)
+	if c.OffsetPageID != 0 {
+		size += 4
+	}
+	return size
+}
+
+func writeCell(w io.Writer, cell Cell) error {
+	err := common.WriteExactly(w, varint.Encode64(cell.PayloadLen))
+	if err != nil {
+		return err
+	}
+	err = common.WriteExactly(w, cell.PayloadInitial)
+	if err != nil {
+		return err
+	}
+	if cell.OffsetPageID != 0 {
+		return binary.Write(w, dbEndianness, cell.OffsetPageID)
+	}
+	return nil
+}
+
+// Reads a cell which takes up exactly cellSize bytes on the page
+func readCell(pb *bytes.Buffer, cellSize int) (Cell, error) {
+	cell := Cell{}
+
+	payloadLen, err := varint.Decode(pb)
+	if err != nil {
+		return Cell{}, err
+	}
+	cell.PayloadLen = payloadLen
+	numBytesPayloadLen := varint.NumBytesNeededToEncode(payloadLen)
+	// If there is no overflow, the payload len will be much larger than the cell size
+	// Be careful! payloadLen could be MAX_INT64
+	// Malicious actors / idiot programmer (aka me) could encode a really large payload len, we have to handle it properly
+	hasOverflow := uint64(cellSize)-uint64(numBytesPayloadLen) < payloadLen
+	localLen := cellSize - numBytesPayloadLen
+	if hasOverflow {
+		// The overflow page ID comes after the initial payload
+		localLen -= 4
+		if localLen < 0 {
+			return Cell{}, errPageCorruption("cell too small to hold an overflow page ID", 4, uint64(cellSize-numBytesPayloadLen))
+		}
+	} else if payloadLen != uint64(localLen) {
+		// Check for page corruption.
+		// Don't cast to int here, which will silently truncate and cause all sorts of weird issues
+		return Cell{}, errPageCorruption("mismatch of pointer length and cell's own length", localLen, payloadLen)
+	}
+
+	payload, err := common.ReadExactly(pb, localLen)
+	if err != nil {
+		return Cell{}, err
+	}
+	cell.PayloadInitial = payload
+	if hasOverflow {
+		err = binary.Read(pb, dbEndianness, &cell.OffsetPageID)
+		if err != nil {
+			return Cell{}, err
+		}
+		if cell.OffsetPageID == 0 {
+			return Cell{}, errPageCorruption("overflowing cell without an overflow page", 1, 0)
+		}
+	}
+	return cell, nil
+}
+
+func readPointers(pb *bytes.Buffer, numCells int, pageSize int) ([]uint16, error) {
+	pointers := make([]uint16, numCells)
+	var prev uint16
+	for i := 0; i < len(pointers); i++ {
+		ptr, err := common.ReadUint16(pb)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && ptr < prev {
+			// pointers can be the same as the previous, if the cell length is zero
+			return nil, errPageCorruption("Pointers should be non-decreasing", int(prev), uint64(ptr))
+		}
+		if int(ptr) >= pageSize {
+			return nil, errPageCorruption("Pointers should be within the page size", pageSize, uint64(ptr))
+		}
+		prev = ptr
+		pointers[i] = ptr
+	}
+	return pointers, nil
+}
+
 const (
 	HeaderLeafPage         = 0x1
+	HeaderInteriorPage     = 0x2
+	HeaderOverflowPage     = 0x3
+	HeaderFreelistPage     = 0x4
 	pageHeaderSize         = 8
 	pageHeaderReservedSize = 5
 )
@@ -0,0 +1,241 @@
+// Encodes keys so that comparing the encoded bytes gives the same order as comparing the values
+// ## Goals:
+//
+// 1. Memcmp two encoded keys determines their order, without decoding
+// 2. Composite keys (a tuple of values) are ordered column by column, so encodings are self delimiting
+// 3. Negative numbers sort before positive numbers
+//
+// ## Encoding
+// Every value starts with a one byte tag, which sorts values of different types by type.
+//
+// Null: 0x00
+// Blob: 0x01, then the bytes with every 0x00 escaped as 0x00 0xFF, then a terminating 0x00
+// String: 0x02, then the UTF-8 bytes, escaped the same way as blobs
+// Integer: 0x0C-0x1C. 0x14 is zero. 0x14+n is a positive integer stored as an n byte big-endian integer,
+// 0x14-n is a negative integer whose absolute value is stored in n bytes, with every bit flipped.
+// Real: 0x21, then the IEEE 754 bits as a big-endian integer. Positive numbers have their sign bit flipped,
+// and negative numbers have every bit flipped.
+//
+// This is similar to the tuple layer of FoundationDB.
+package keycodec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+const (
+	tagNull    = 0x00
+	tagBlob    = 0x01
+	tagString  = 0x02
+	tagIntZero = 0x14
+	tagReal    = 0x21
+
+	tagIntMin = tagIntZero - 8
+	tagIntMax = tagIntZero + 8
+
+	escapeByte = 0xFF
+)
+
+var ErrInvalidKey = errors.New("keycodec: invalid encoded key")
+
+// Encodes a tuple of values as a single key
+func Encode(vals ...interface{}) ([]byte, error) {
+	var err error
+	buf := make([]byte, 0, 16*len(vals))
+	for _, val := range vals {
+		buf, err = Append(buf, val)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// Appends the encoding of a single value to buf.
+// Bools are encoded as the integers 0 and 1.
+func Append(buf []byte, val interface{}) ([]byte, error) {
+	if val == nil {
+		return append(buf, tagNull), nil
+	}
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return appendUint(buf, 1), nil
+		}
+		return appendUint(buf, 0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendInt(buf, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendUint(buf, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return appendReal(buf, v.Float()), nil
+	case reflect.String:
+		return appendBytes(append(buf, tagString), []byte(v.String())), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return appendBytes(append(buf, tagBlob), v.Bytes()), nil
+		}
+	}
+	return nil, fmt.Errorf("keycodec: cannot encode a value of type %T", val)
+}
+
+func appendInt(buf []byte, x int64) []byte {
+	if x >= 0 {
+		return appendUint(buf, uint64(x))
+	}
+	// Careful, the absolute value of the smallest int64 doesn't fit in an int64
+	abs := uint64(-(x + 1)) + 1
+	n := numBytes(abs)
+	buf = append(buf, byte(tagIntZero-n))
+	return appendBigEndian(buf, ^abs, n)
+}
+
+func appendUint(buf []byte, x uint64) []byte {
+	n := numBytes(x)
+	buf = append(buf, byte(tagIntZero+n))
+	return appendBigEndian(buf, x, n)
+}
+
+func appendReal(buf []byte, f float64) []byte {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	buf = append(buf, tagReal)
+	return binary.BigEndian.AppendUint64(buf, bits)
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	for _, c := range b {
+		buf = append(buf, c)
+		if c == 0x00 {
+			buf = append(buf, escapeByte)
+		}
+	}
+	return append(buf, 0x00)
+}
+
+// Appends the n least significant bytes of x
+func appendBigEndian(buf []byte, x uint64, n int) []byte {
+	for i := n - 1; i >= 0; i-- {
+		buf = append(buf, byte(x>>(8*i)))
+	}
+	return buf
+}
+
+// The number of bytes needed to hold x
+func numBytes(x uint64) int {
+	n := 0
+	for x > 0 {
+		n++
+		x >>= 8
+	}
+	return n
+}
+
+// Decodes a key with exactly n values
+func DecodeN(key []byte, n int) ([]interface{}, error) {
+	vals := make([]interface{}, n)
+	var err error
+	for i := range vals {
+		vals[i], key, err = Decode(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(key) != 0 {
+		return nil, ErrInvalidKey
+	}
+	return vals, nil
+}
+
+// Decodes the first value of a key, and returns the rest of the key.
+// Integers are decoded as int64, unless they are too large, in which case they are uint64.
+// Reals are decoded as float64, strings as string and blobs as []byte
+func Decode(key []byte) (interface{}, []byte, error) {
+	if len(key) == 0 {
+		return nil, nil, ErrInvalidKey
+	}
+	tag, rest := key[0], key[1:]
+	switch {
+	case tag == tagNull:
+		return nil, rest, nil
+	case tag == tagBlob:
+		b, rest, err := decodeBytes(rest)
+		return b, rest, err
+	case tag == tagString:
+		b, rest, err := decodeBytes(rest)
+		return string(b), rest, err
+	case tag >= tagIntMin && tag <= tagIntMax:
+		return decodeInt(tag, rest)
+	case tag == tagReal:
+		if len(rest) < 8 {
+			return nil, nil, ErrInvalidKey
+		}
+		bits := binary.BigEndian.Uint64(rest)
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), rest[8:], nil
+	}
+	return nil, nil, ErrInvalidKey
+}
+
+func decodeInt(tag byte, rest []byte) (interface{}, []byte, error) {
+	negative := tag < tagIntZero
+	n := int(tag) - tagIntZero
+	if negative {
+		n = -n
+	}
+	if len(rest) < n {
+		return nil, nil, ErrInvalidKey
+	}
+	var x uint64
+	for _, c := range rest[:n] {
+		x = x<<8 | uint64(c)
+	}
+	rest = rest[n:]
+	if !negative {
+		if x > math.MaxInt64 {
+			return x, rest, nil
+		}
+		return int64(x), rest, nil
+	}
+	// Undo the bit flip, only for the n bytes that were stored
+	abs := ^x
+	if n < 8 {
+		abs &= 1<<(8*n) - 1
+	}
+	if abs > 1<<63 {
+		return nil, nil, ErrInvalidKey
+	}
+	return -int64(abs-1) - 1, rest, nil
+}
+
+func decodeBytes(key []byte) ([]byte, []byte, error) {
+	b := make([]byte, 0, len(key))
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c != 0x00 {
+			b = append(b, c)
+			continue
+		}
+		if i+1 < len(key) && key[i+1] == escapeByte {
+			b = append(b, 0x00)
+			i++
+			continue
+		}
+		return b, key[i+1:], nil
+	}
+	// No terminator
+	return nil, nil, ErrInvalidKey
+}
@@ -0,0 +1,122 @@
+package keycodec_test
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/thomastay/rash-db/pkg/keycodec"
+)
+
+func TestIntOrder(t *testing.T) {
+	// In increasing order
+	ints := []int64{math.MinInt64, math.MinInt64 + 1, -1 << 40, -65536, -65535, -256, -255, -2, -1, 0, 1, 255, 256, 65535, 1 << 40, math.MaxInt64}
+	checkOrder(t, ints)
+}
+
+func TestIntRoundTrip(t *testing.T) {
+	for i := int64(-70000); i <= 70000; i++ {
+		b, err := keycodec.Encode(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals, err := keycodec.DecodeN(b, 1)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if vals[0] != i {
+			t.Fatalf("%d: Decoded %v", i, vals[0])
+		}
+	}
+	b, err := keycodec.Encode(uint64(math.MaxUint64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals, err := keycodec.DecodeN(b, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vals[0] != uint64(math.MaxUint64) {
+		t.Fatalf("Decoded %v", vals[0])
+	}
+}
+
+func TestUintOrder(t *testing.T) {
+	checkOrder(t, []interface{}{int64(-5), uint64(0), int8(3), uint16(300), uint64(math.MaxInt64), uint64(math.MaxInt64) + 1, uint64(math.MaxUint64)})
+}
+
+func TestRealOrder(t *testing.T) {
+	checkOrder(t, []float64{math.Inf(-1), -1e300, -2.5, -1, -math.SmallestNonzeroFloat64, 0, math.SmallestNonzeroFloat64, 0.5, 1, 3.75, 1e300, math.Inf(1)})
+}
+
+func TestStringOrder(t *testing.T) {
+	checkOrder(t, []string{"", "\x00", "\x00\x00", "\x00\x01", "\x01", "A", "AB", "B", "a", "a\x00", "a\x00b", "ab", "\xff"})
+	checkOrder(t, [][]byte{{}, {0}, {0, 0}, {0, 0xff}, {1}, {0xff}, {0xff, 0}})
+}
+
+func TestCompositeOrder(t *testing.T) {
+	// (Symbol, Timestamp)
+	keys := [][]interface{}{
+		{"HELE", int64(-1)},
+		{"HELE", int64(1695885689)},
+		{"SPY", int64(5)},
+		{"SPY", int64(1695885688)},
+		{"SPY\x00", int64(0)},
+		{"SPYX", int64(-100)},
+	}
+	encoded := make([][]byte, len(keys))
+	for i, key := range keys {
+		var err error
+		encoded[i], err = keycodec.Encode(key...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := keycodec.DecodeN(encoded[i], len(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, key) {
+			t.Fatalf("Expected %v, decoded %v", key, decoded)
+		}
+	}
+	for i := 1; i < len(encoded); i++ {
+		if bytes.Compare(encoded[i-1], encoded[i]) >= 0 {
+			t.Errorf("%v should sort before %v", keys[i-1], keys[i])
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, b := range [][]byte{{}, {0x02, 'a'}, {0x16, 0x01}, {0x21, 0, 0}, {0xff}} {
+		_, _, err := keycodec.Decode(b)
+		if err != keycodec.ErrInvalidKey {
+			t.Errorf("%v: expected ErrInvalidKey, got %v", b, err)
+		}
+	}
+	b, _ := keycodec.Encode("a", int64(1))
+	_, err := keycodec.DecodeN(b, 1)
+	if err != keycodec.ErrInvalidKey {
+		t.Errorf("Expected trailing data to be rejected, got %v", err)
+	}
+}
+
+func checkOrder[T any](t *testing.T, vals []T) {
+	t.Helper()
+	encoded := make([][]byte, len(vals))
+	for i, val := range vals {
+		var err error
+		encoded[i], err = keycodec.Encode(val)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range encoded {
+		for j := range encoded {
+			c := bytes.Compare(encoded[i], encoded[j])
+			if (i < j && c >= 0) || (i == j && c != 0) || (i > j && c <= 0) {
+				t.Errorf("Wrong order for %v and %v: %d", vals[i], vals[j], c)
+			}
+		}
+	}
+}
@@ -117,7 +117,8 @@ func Decode(r io.Reader) (uint64, error) {
 	// Else, it is encoded as a big-endian integer in the rest of the bytes
 	numBytesToRead := first - 247 // 249:2, 250:3, ... 255:8
 	var buf [8]byte
-	n, err := r.Read(buf[:])
+	// Only read as many bytes as the first byte tells us to, r might have more data after this varint
+	n, err := r.Read(buf[:numBytesToRead])
 	if n != int(numBytesToRead) {
 		return 0, io.ErrUnexpectedEOF
 	}
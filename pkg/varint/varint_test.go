@@ -95,6 +95,23 @@ func TestFourByteVarInt(t *testing.T) {
 	}
 }
 
+func TestDecodeStopsAtEndOfVarInt(t *testing.T) {
+	for _, i := range []uint64{5, 1000, 40000, 1 << 20, 1 << 40} {
+		b := append(varint.Encode64(i), 0xAB, 0xCD)
+		buf := bytes.NewBuffer(b)
+		decoded, err := varint.Decode(buf)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+		if decoded != i {
+			t.Errorf("%d: Decoded %d", i, decoded)
+		}
+		if buf.Len() != 2 {
+			t.Errorf("%d: Expected 2 trailing bytes to be left, got %d", i, buf.Len())
+		}
+	}
+}
+
 // func TestBiggerVarIntQuick(t *testing.T) {
 // 	seen := make(map[uint64]bool)
 // 	for i := uint64(2288); i <= 100000; i++ {
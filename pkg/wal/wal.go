@@ -0,0 +1,289 @@
+// Package wal implements the write-ahead log.
+//
+// Pages are never written to the DB file while they are being committed. Instead, the new versions
+// of every page in a commit are appended to the log, followed by a commit record, and the log is synced.
+// Later on, the log is checkpointed: the latest version of every page is copied into the DB file, and the log is emptied.
+// A crash can then only ever lose a commit that wasn't finished, since the log is replayed when the DB is opened.
+//
+// ```
+// (Header - fixed 16 bytes)
+// +-------+-----------+------+----------+
+// + Magic + Page size + Salt + Checksum +  (four bytes each)
+// +-------+-----------+------+----------+
+//
+// (Frames - one for each page)
+// +---------+---------+------+----------+======+
+// + Page ID + DB size + Salt + Checksum + Page +  (four bytes each, then the page)
+// +---------+---------+------+----------+======+
+// ```
+//
+// The DB size is the number of pages in the DB after the commit, and is only set on the last frame of a commit,
+// which makes that frame the commit record. It is zero on every other frame.
+//
+// Checksums are chained: each one covers the frame (or header) and the checksum before it.
+// So a frame only counts if every frame before it is intact.
+// The salt changes every time the log is emptied, so frames left over from before then are never replayed.
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+type WAL struct {
+	file     *os.File
+	pageSize int // 0 until the first frame is written
+	salt     uint32
+	// Checksum of the last frame, which the next frame's checksum continues from
+	checksum uint32
+	// Where the next frame goes. 0 if the header hasn't been written yet
+	end int64
+
+	// Offset of the latest committed version of every page in the log
+	pages  map[int]int64
+	dbSize int
+}
+
+// A new version of a page
+type Frame struct {
+	PageID int
+	Data   []byte
+}
+
+// Opens the log at path, creating it if it doesn't exist.
+// Every commit in the log is read in. Frames after the last complete commit are ignored.
+func Open(path string) (*WAL, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{
+		file:  file,
+		pages: make(map[int]int64),
+	}
+	err = w.replay()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *WAL) replay() error {
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	header := make([]byte, headerSize)
+	_, err = w.file.ReadAt(header, 0)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Nothing was ever committed
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if order.Uint32(header) != magic || order.Uint32(header[12:]) != crc32.Checksum(header[:12], table) {
+		// The header is written together with the first commit, so that commit never finished
+		return nil
+	}
+	w.pageSize = int(order.Uint32(header[4:]))
+	w.salt = order.Uint32(header[8:])
+	w.checksum = order.Uint32(header[12:])
+	w.end = headerSize
+
+	// Frames since the last commit record
+	pending := make(map[int]int64)
+	checksum := w.checksum
+	frame := make([]byte, frameHeaderSize+w.pageSize)
+	for offset := int64(headerSize); offset+int64(len(frame)) <= info.Size(); offset += int64(len(frame)) {
+		_, err = w.file.ReadAt(frame, offset)
+		if err != nil {
+			return err
+		}
+		if order.Uint32(frame[8:]) != w.salt {
+			break
+		}
+		checksum = frameChecksum(checksum, frame)
+		if order.Uint32(frame[12:]) != checksum {
+			break
+		}
+		pageID := int(order.Uint32(frame))
+		pending[pageID] = offset + frameHeaderSize
+		if dbSize := int(order.Uint32(frame[4:])); dbSize != 0 {
+			for ID, pageOffset := range pending {
+				w.pages[ID] = pageOffset
+			}
+			pending = make(map[int]int64)
+			w.dbSize = dbSize
+			w.checksum = checksum
+			w.end = offset + int64(len(frame))
+		}
+	}
+	return nil
+}
+
+// Appends the frames to the log as a single commit, and syncs the log.
+// dbSize is the number of pages in the DB once the commit is applied.
+func (w *WAL) Commit(frames []Frame, dbSize int) error {
+	if len(frames) == 0 {
+		return nil
+	}
+	if dbSize <= 0 {
+		return errors.New("wal: the DB must have at least one page")
+	}
+	if w.pageSize == 0 {
+		w.pageSize = len(frames[0].Data)
+	}
+	frameSize := frameHeaderSize + w.pageSize
+
+	buf := make([]byte, 0, headerSize+len(frames)*frameSize)
+	checksum := w.checksum
+	if w.end == 0 {
+		buf = order.AppendUint32(buf, magic)
+		buf = order.AppendUint32(buf, uint32(w.pageSize))
+		buf = order.AppendUint32(buf, w.salt)
+		checksum = crc32.Checksum(buf, table)
+		buf = order.AppendUint32(buf, checksum)
+	}
+	for i, frame := range frames {
+		if len(frame.Data) != w.pageSize {
+			return errors.New("wal: frame is not the size of a page")
+		}
+		start := len(buf)
+		buf = order.AppendUint32(buf, uint32(frame.PageID))
+		if i == len(frames)-1 {
+			buf = order.AppendUint32(buf, uint32(dbSize))
+		} else {
+			buf = order.AppendUint32(buf, 0)
+		}
+		buf = order.AppendUint32(buf, w.salt)
+		buf = order.AppendUint32(buf, 0) // checksum, filled in below
+		buf = append(buf, frame.Data...)
+		checksum = frameChecksum(checksum, buf[start:])
+		order.PutUint32(buf[start+12:], checksum)
+	}
+
+	_, err := w.file.WriteAt(buf, w.end)
+	if err != nil {
+		return err
+	}
+	err = w.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	// Only now is the commit durable
+	offset := w.end
+	if w.end == 0 {
+		offset = headerSize
+	}
+	for _, frame := range frames {
+		w.pages[frame.PageID] = offset + frameHeaderSize
+		offset += int64(frameSize)
+	}
+	w.checksum = checksum
+	w.end = offset
+	w.dbSize = dbSize
+	return nil
+}
+
+// Returns the latest committed version of a page, or false if the page isn't in the log
+func (w *WAL) ReadPage(ID int) ([]byte, bool, error) {
+	offset, ok := w.pages[ID]
+	if !ok {
+		return nil, false, nil
+	}
+	buf := make([]byte, w.pageSize)
+	_, err := w.file.ReadAt(buf, offset)
+	if err != nil {
+		return nil, false, err
+	}
+	return buf, true, nil
+}
+
+// The number of pages in the DB as of the last commit, or 0 if the log is empty
+func (w *WAL) DBSize() int {
+	return w.dbSize
+}
+
+// The number of distinct pages in the log
+func (w *WAL) NumPages() int {
+	return len(w.pages)
+}
+
+// The size of the pages in the log, or 0 if nothing was ever committed to it
+func (w *WAL) PageSize() int {
+	return w.pageSize
+}
+
+// Copies the latest version of every page in the log into the DB file, then empties the log.
+// If this is interrupted, the log is still intact, so the next checkpoint copies the pages again.
+func (w *WAL) Checkpoint(db *os.File) error {
+	if len(w.pages) == 0 {
+		return nil
+	}
+	IDs := make([]int, 0, len(w.pages))
+	for ID := range w.pages {
+		IDs = append(IDs, ID)
+	}
+	sort.Ints(IDs)
+	for _, ID := range IDs {
+		page, _, err := w.ReadPage(ID)
+		if err != nil {
+			return err
+		}
+		_, err = db.WriteAt(page, int64(ID-1)*int64(w.pageSize))
+		if err != nil {
+			return err
+		}
+	}
+	err := db.Sync()
+	if err != nil {
+		return err
+	}
+	return w.reset()
+}
+
+// Empties the log
+func (w *WAL) reset() error {
+	err := w.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	err = w.file.Sync()
+	if err != nil {
+		return err
+	}
+	w.salt++
+	w.checksum = 0
+	w.end = 0
+	w.pages = make(map[int]int64)
+	w.dbSize = 0
+	return nil
+}
+
+func (w *WAL) Close() error {
+	return w.file.Close()
+}
+
+// Continues the checksum over a frame, skipping the frame's own checksum
+func frameChecksum(prev uint32, frame []byte) uint32 {
+	checksum := crc32.Update(prev, table, frame[:12])
+	return crc32.Update(checksum, table, frame[frameHeaderSize:])
+}
+
+const (
+	magic           = 0x72617368 // "rash"
+	headerSize      = 16
+	frameHeaderSize = 16
+)
+
+var (
+	order = binary.BigEndian
+	table = crc32.MakeTable(crc32.Castagnoli)
+)
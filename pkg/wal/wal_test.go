@@ -0,0 +1,162 @@
+package wal_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thomastay/rash-db/pkg/wal"
+)
+
+const pageSize = 512
+
+func page(b byte) []byte {
+	return bytes.Repeat([]byte{b}, pageSize)
+}
+
+func openWAL(t *testing.T, path string) *wal.WAL {
+	w, err := wal.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+func checkPage(t *testing.T, w *wal.WAL, ID int, expected []byte) {
+	t.Helper()
+	got, ok, err := w.ReadPage(ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected == nil {
+		if ok {
+			t.Fatalf("Page %d should not be in the log", ID)
+		}
+		return
+	}
+	if !ok || !bytes.Equal(got, expected) {
+		t.Fatalf("Page %d does not have the committed contents", ID)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db-wal")
+	w := openWAL(t, path)
+	err := w.Commit([]wal.Frame{{1, page(1)}, {2, page(2)}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Commit([]wal.Frame{{2, page(3)}, {3, page(4)}}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last commit is torn in the middle of its last frame
+	err = w.Commit([]wal.Frame{{1, page(5)}, {4, page(6)}}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	err = os.Truncate(path, info.Size()+pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = openWAL(t, path)
+	if w.DBSize() != 3 {
+		t.Fatalf("Expected a DB size of 3, got %d", w.DBSize())
+	}
+	if w.PageSize() != pageSize {
+		t.Fatalf("Expected a page size of %d, got %d", pageSize, w.PageSize())
+	}
+	checkPage(t, w, 1, page(1))
+	checkPage(t, w, 2, page(3))
+	checkPage(t, w, 3, page(4))
+	checkPage(t, w, 4, nil)
+
+	// Commits carry on after the last complete one
+	err = w.Commit([]wal.Frame{{4, page(7)}}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	w = openWAL(t, path)
+	checkPage(t, w, 4, page(7))
+}
+
+func TestCorruptFrame(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db-wal")
+	w := openWAL(t, path)
+	err := w.Commit([]wal.Frame{{1, page(1)}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Commit([]wal.Frame{{1, page(2)}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// Flip a byte in the second commit's page
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{0xff}, info.Size()-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	w = openWAL(t, path)
+	checkPage(t, w, 1, page(1))
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	db, err := os.Create(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	path := filepath.Join(dir, "test.db-wal")
+	w := openWAL(t, path)
+	err = w.Commit([]wal.Frame{{2, page(2)}, {1, page(1)}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Checkpoint(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(db.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, append(page(1), page(2)...)) {
+		t.Fatal("The DB file does not hold the checkpointed pages")
+	}
+	if w.NumPages() != 0 || w.DBSize() != 0 {
+		t.Fatal("Expected the log to be empty after a checkpoint")
+	}
+	checkPage(t, w, 1, nil)
+
+	// The log is reused after it is emptied
+	err = w.Commit([]wal.Frame{{1, page(3)}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	w = openWAL(t, path)
+	checkPage(t, w, 1, page(3))
+	checkPage(t, w, 2, nil)
+}
@@ -1,40 +1,104 @@
 package rashdb
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
 	"os"
 	"reflect"
+	"sync"
 
 	"github.com/thomastay/rash-db/pkg/app"
 	"github.com/thomastay/rash-db/pkg/common"
 	"github.com/thomastay/rash-db/pkg/disk"
+	"github.com/thomastay/rash-db/pkg/wal"
 )
 
 type DB struct {
 	path   string
 	file   *os.File
 	header disk.Header
-	// lock   sync.Mutex
+	// Guards writer, since read transactions can be started from any goroutine
+	mu sync.Mutex
+	// Held while the implicit transaction is used, since DB.Insert and friends can be called from any goroutine.
+	// It is taken before mu
+	implicitMu sync.Mutex
 
-	// Cache of recently created / updated tables.
+	// Cache of tables that have been created or looked up by the writer.
 	tables map[string]*tableNode
 	pager  *app.Pager
+	// Every change is committed to the write-ahead log before it goes into the DB file
+	wal *wal.WAL
+	// The schema table, which holds the schema of every table. It is rooted at page 1
+	schema *app.BTree
+	// The open writable transaction, if there is one
+	writer *Tx
 }
 
 type DBOpenOptions struct {
+	// The page size of a new DB. Existing DBs keep the page size they were created with.
 	PageSize int
+	// Creates the DB if the file doesn't exist. This is the default if neither flag is set.
+	CreateIfMissing bool
+	// Fails with an error wrapping os.ErrNotExist if the file doesn't exist
+	MustExist bool
 }
 
+// Opens the DB stored in filename. Options may be nil.
 func Open(filename string, options *DBOpenOptions) (*DB, error) {
+	if options == nil {
+		options = &DBOpenOptions{}
+	}
+	if options.CreateIfMissing && options.MustExist {
+		return nil, ErrInvalidOpenOptions
+	}
+	if options.PageSize != 0 && (options.PageSize < disk.MinDBPageSize || options.PageSize > math.MaxUint16) {
+		return nil, ErrInvalidOpenOptions
+	}
+	flag := os.O_RDWR
+	if !options.MustExist {
+		flag |= os.O_CREATE
+	}
+
 	var err error
 	db := DB{path: filename}
-	db.file, err = os.Create(filename)
+	db.file, err = os.OpenFile(filename, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	db.wal, err = wal.Open(filename + "-wal")
+	if err != nil {
+		db.file.Close()
+		return nil, err
+	}
+	err = db.open(options)
 	if err != nil {
+		db.wal.Close()
+		db.file.Close()
+		if db.wal.DBSize() == 0 {
+			// Don't leave an empty log behind, which may be next to a file that isn't a DB
+			os.Remove(filename + "-wal")
+		}
 		return nil, err
 	}
+	return &db, nil
+}
+
+func (db *DB) open(options *DBOpenOptions) error {
+	err := db.checkHeaders()
+	if err != nil {
+		return err
+	}
+	// Replay every commit that was in the log, but not yet in the DB file, when the DB was last closed
+	err = db.wal.Checkpoint(db.file)
+	if err != nil {
+		return err
+	}
 	// Check if the opened file exists
 	info, err := db.file.Stat()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if info.Size() == 0 {
 		// initialize DB
@@ -43,46 +107,217 @@ func Open(filename string, options *DBOpenOptions) (*DB, error) {
 		} else {
 			db.header.PageSize = uint16(options.PageSize)
 		}
+		db.header.Magic = disk.MagicHeader
+		db.header.Version = disk.DBVersion
 
 		db.init()
-		return &db, nil
+		db.schema, err = app.CreateSchemaTree(db.pager, &db.header)
+		if err != nil {
+			return err
+		}
+		// The empty DB is committed straight away, so that it's never rolled back
+		return db.pager.Flush()
 	}
 	// Else, DB exists. Read from it.
 
 	headerBytes, err := common.ReadExactly(db.file, disk.DBHeaderSize)
 	if err != nil {
-		return nil, err
+		return ErrInvalid
 	}
 	err = db.header.UnmarshalBinary(headerBytes)
 	if err != nil {
-		return nil, err
+		return ErrInvalid
+	}
+	if db.header.Magic != disk.MagicHeader || db.header.Version != disk.DBVersion {
+		return ErrInvalid
+	}
+	pageSize := int64(db.header.PageSize)
+	numPages := int64(db.header.NumPages)
+	if pageSize < disk.MinDBPageSize || numPages == 0 || info.Size() < numPages*pageSize {
+		return ErrInvalid
 	}
 
 	db.init()
-	return &db, nil
+	db.pager.SetDBSize(int(numPages))
+	err = db.pager.LoadFreelist(int(db.header.FreelistTrunk), int(db.header.FreelistCount))
+	if err != nil {
+		return err
+	}
+	db.schema = app.OpenSchemaTree(db.pager)
+	return nil
+}
+
+// Checks the headers of the DB file and of the first page in the log, before the log is replayed into the file,
+// so that a file that isn't a DB is never written to. The first page is in the log if the DB was never checkpointed.
+// Only the parts of the header that never change are checked here.
+func (db *DB) checkHeaders() error {
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	var headers [][]byte
+	if info.Size() > 0 {
+		headerBytes, err := common.ReadExactly(io.NewSectionReader(db.file, 0, disk.DBHeaderSize), disk.DBHeaderSize)
+		if err != nil {
+			return ErrInvalid
+		}
+		headers = append(headers, headerBytes)
+	}
+	firstPage, ok, err := db.wal.ReadPage(1)
+	if err != nil {
+		return err
+	}
+	if ok {
+		headers = append(headers, firstPage)
+	}
+	for _, headerBytes := range headers {
+		var header disk.Header
+		if len(headerBytes) < disk.DBHeaderSize || header.UnmarshalBinary(headerBytes[:disk.DBHeaderSize]) != nil {
+			return ErrInvalid
+		}
+		if header.Magic != disk.MagicHeader || header.Version != disk.DBVersion || header.PageSize < disk.MinDBPageSize {
+			return ErrInvalid
+		}
+		// The log has to be for a DB with the same pages
+		if db.wal.NumPages() > 0 && db.wal.PageSize() != int(header.PageSize) {
+			return ErrInvalid
+		}
+	}
+	if len(headers) == 0 && db.wal.NumPages() > 0 {
+		// The log doesn't belong to this file, which would be new otherwise
+		return ErrInvalid
+	}
+	return nil
+}
+
+// Closes the DB file. Changes that haven't been committed are lost.
+// Every read transaction must be finished first.
+func (db *DB) Close() error {
+	db.implicitMu.Lock()
+	defer db.implicitMu.Unlock()
+	db.mu.Lock()
+	writer := db.writer
+	db.mu.Unlock()
+	if writer != nil {
+		writer.Rollback()
+	}
+	err := db.pager.Checkpoint()
+	if err != nil {
+		db.wal.Close()
+		db.file.Close()
+		return err
+	}
+	err = db.wal.Close()
+	if err != nil {
+		db.file.Close()
+		return err
+	}
+	// The log is empty, and is only needed while the DB is open
+	err = os.Remove(db.path + "-wal")
+	if err != nil {
+		db.file.Close()
+		return err
+	}
+	return db.file.Close()
 }
 
 // This is to be called to setup in memory data structures,
 // after either the headers have been read from disk, or created.
 func (db *DB) init() {
 	db.pager = app.NewPager(int(db.header.PageSize), db.file)
+	db.pager.SetWAL(db.wal)
 	db.tables = make(map[string]*tableNode)
 }
 
+// Creates a table whose columns are the fields of tableType.
+// The primary key is made up of one or more of those columns, and rows are ordered by the primary key columns,
+// in the order they're given here. A table without a primary key gets a hidden integer key called rowid instead,
+// which autoincrements.
+//
+// Columns are named after their fields, unless a field has a struct tag. These work like encoding/json's:
+//
+//	type User struct {
+//		ID    int64  `rashdb:"id,pk"`
+//		Email string `rashdb:"email,unique,notnull"`
+//		Cache []byte `rashdb:"-"`
+//	}
+//
+// The first part of the tag is the column name, or the field name if it is empty. A tag of "-" skips the field,
+// so it is neither stored nor filled in. After the name come any of these options:
+//   - pk: the column is part of the primary key, in field order. Then primaryKey must be empty
+//   - omitempty: the zero value of the field is stored as NULL
+//   - notnull: the column may not be NULL. Primary key columns are never NULL
+//   - index: the column gets an index of its own
+//   - unique: no two rows may have the same value in the column, see TableOptions.Unique
+//   - autoincrement: the column is the primary key, and rows inserted without it get the next ID. See TableOptions.AutoIncrement
+//
+// Pointer fields and the sql.Null* types are stored as NULL when they are nil, or not Valid.
+// So is a column that the inserted struct has no field for.
 func (db *DB) CreateTable(
 	tableName string,
 	tableType interface{},
-	primaryKey string,
+	primaryKey ...string,
 ) error {
-	tbl, err := db.createTable(tableName, tableType, primaryKey)
-	if err != nil {
-		return err
-	}
-	db.tables[tableName] = tbl
-	return nil
+	return db.implicitUpdate(func(tx *Tx) error {
+		return tx.CreateTable(tableName, tableType, primaryKey...)
+	})
+}
+
+// The options of a new table
+type TableOptions struct {
+	// The primary key columns, in the order that rows are sorted by.
+	// If there are none, the rows are keyed by a hidden RowIDColumn, which autoincrements.
+	PrimaryKey []string
+	// An integer primary key column, which must be the whole primary key. When a row is inserted with a zero or nil
+	// value for it, it is given the table's next ID: one more than the largest ID that the table has had.
+	// IDs aren't reused, even if their rows are deleted.
+	AutoIncrement string
+	// Columns which must have a different value in every row. Each of them gets a unique index
+	Unique []string
+	// Columns which each get an index of their own
+	Index []string
+}
+
+// The primary key column of a table that was created without a primary key
+const RowIDColumn = "rowid"
+
+// Creates a table whose columns are the fields of tableType, with the given options.
+// The table is only committed by SyncAll.
+func (db *DB) CreateTableWithOptions(
+	tableName string,
+	tableType interface{},
+	options *TableOptions,
+) error {
+	return db.implicitUpdate(func(tx *Tx) error {
+		return tx.CreateTableWithOptions(tableName, tableType, options)
+	})
+}
+
+// Deletes a table and its indexes, outside of any explicit transaction.
+// The change is only committed by SyncAll.
+func (db *DB) DropTable(tableName string) error {
+	return db.implicitUpdate(func(tx *Tx) error {
+		return tx.DropTable(tableName)
+	})
+}
+
+// Renames a table, outside of any explicit transaction.
+// The change is only committed by SyncAll.
+func (db *DB) RenameTable(oldName string, newName string) error {
+	return db.implicitUpdate(func(tx *Tx) error {
+		return tx.RenameTable(oldName, newName)
+	})
+}
+
+// Creates an index on some of the columns of a table, outside of any explicit transaction.
+// The index is only committed by SyncAll.
+func (db *DB) CreateIndex(tableName string, indexName string, columns ...string) error {
+	return db.implicitUpdate(func(tx *Tx) error {
+		return tx.CreateIndex(tableName, indexName, columns...)
+	})
 }
 
-// Looks the table up from table cache or disk. Returns nil if it cannot find it.
+// Looks the table up from the writer's table cache or disk. Returns nil if it cannot find it.
 func (db *DB) lookupTable(
 	tableName string,
 ) (*tableNode, error) {
@@ -90,204 +325,678 @@ func (db *DB) lookupTable(
 		return tbl, nil
 	}
 	// if not, find it from the on-disk schema table
-	// this must be an already created database
-	pagerInfo, err := db.pager.Request(app.DBSchemaPageID)
-	if err != nil {
+	// The table's data is read lazily, page by page, as it is needed
+	tblNode, err := loadTable(db, db.schema, tableName, func(root int) *app.BTree {
+		return app.NewBTree(root, db.pager)
+	})
+	if err != nil || tblNode == nil {
 		return nil, err
 	}
-	defer pagerInfo.Done()
-	schemas, err := app.DecodeSchemaPage(pagerInfo.Page)
+	db.tables[tableName] = tblNode
+	return tblNode, nil
+}
+
+// Whether a table or an index called name exists, as the writer sees it
+func (db *DB) nameExists(name string) (bool, error) {
+	for tblName, tbl := range db.tables {
+		if tblName == name {
+			return true, nil
+		}
+		for _, idx := range tbl.indexes {
+			if idx.schema.Name == name {
+				return true, nil
+			}
+		}
+	}
+	exists, err := app.SchemaNameExists(db.schema, name)
+	return exists, schemaError(err)
+}
+
+// Inserts val as a new row of the table, outside of any explicit transaction, and returns its ID if the table has an
+// autoincrementing key. See Tx.Insert. The row is only committed by SyncAll.
+func (db *DB) Insert(
+	tableName string,
+	val interface{},
+) (int64, error) {
+	var id int64
+	err := db.implicitUpdate(func(tx *Tx) error {
+		var err error
+		id, err = tx.Insert(tableName, val)
+		return err
+	})
+	return id, err
+}
+
+// Replaces the row that has the same primary key as val, outside of any explicit transaction.
+// It's not called Update, since that runs a transaction. The change is only committed by SyncAll.
+func (db *DB) UpdateRow(
+	tableName string,
+	val interface{},
+) error {
+	return db.implicitUpdate(func(tx *Tx) error {
+		return tx.Update(tableName, val)
+	})
+}
+
+// Inserts val as a new row of the table, replacing the row that has the same primary key if there is one.
+// The change is only committed by SyncAll.
+func (db *DB) Upsert(
+	tableName string,
+	val interface{},
+) error {
+	return db.implicitUpdate(func(tx *Tx) error {
+		return tx.Upsert(tableName, val)
+	})
+}
+
+// Deletes the row with the given primary key, outside of any explicit transaction.
+// For tables with more than one primary key column, key must be a Key.
+// The change is only committed by SyncAll.
+func (db *DB) Delete(tableName string, key interface{}) error {
+	return db.implicitUpdate(func(tx *Tx) error {
+		return tx.Delete(tableName, key)
+	})
+}
+
+// Finds the row with the given primary key, and fills in dest with it.
+// For tables with more than one primary key column, key must be a Key.
+// dest must be a pointer to a struct of the same type that the table was created with.
+// Rows inserted with DB.Insert are visible even before SyncAll. Otherwise, this reads the last committed version.
+func (db *DB) Get(
+	tableName string,
+	key interface{},
+	dest interface{},
+) error {
+	return db.implicitView(func(tx *Tx) error {
+		return tx.Get(tableName, key, dest)
+	})
+}
+
+// Finds the first row, in primary key order, whose indexed columns are equal to key, and fills in dest with it.
+// Rows inserted with DB.Insert are visible even before SyncAll. Otherwise, this reads the last committed version.
+func (db *DB) GetByIndex(
+	tableName string,
+	indexName string,
+	key interface{},
+	dest interface{},
+) error {
+	return db.implicitView(func(tx *Tx) error {
+		return tx.GetByIndex(tableName, indexName, key, dest)
+	})
+}
+
+// Commits every change made outside of an explicit transaction to the write-ahead log.
+// Once this returns, the changes survive a crash.
+func (db *DB) SyncAll() error {
+	db.implicitMu.Lock()
+	defer db.implicitMu.Unlock()
+	db.mu.Lock()
+	writer := db.writer
+	db.mu.Unlock()
+	if writer == nil {
+		return nil
+	}
+	if !writer.implicit {
+		return ErrTxInProgress
+	}
+	return writer.Commit()
+}
+
+// Uses reflection to figure out what fields are available on a struct.
+// cols are the columns that the fields of the struct map onto, and options already include the struct tags.
+func (db *DB) createTable(tableName string, tableType reflect.Type, cols []fieldColumn, options *TableOptions) (*tableNode, error) {
+	primaryKey := options.PrimaryKey
+	rowID := len(primaryKey) == 0
+	if rowID {
+		if options.AutoIncrement != "" {
+			return nil, ErrCreateTableInvalidAutoIncrement(options.AutoIncrement)
+		}
+		primaryKey = []string{RowIDColumn}
+	}
+	if options.AutoIncrement != "" && (len(primaryKey) != 1 || primaryKey[0] != options.AutoIncrement) {
+		return nil, ErrCreateTableInvalidAutoIncrement(options.AutoIncrement)
+	}
+	schema := app.TableSchema{
+		Name:       tableName,
+		PrimaryKey: make([]app.TableColumn, len(primaryKey)),
+	}
+	keyIndex := make(map[string]int, len(primaryKey))
+	for i, name := range primaryKey {
+		if _, ok := keyIndex[name]; ok {
+			return nil, ErrCreateTableInvalidKey(name)
+		}
+		keyIndex[name] = i
+	}
+
+	columns := make([]app.TableColumn, 0)
+	colsMap := make(map[string]app.DataType)
+
+	for _, fieldCol := range cols {
+		field := tableType.Field(fieldCol.field)
+		col := app.TableColumn{Key: fieldCol.name, NotNull: fieldCol.notNull}
+
+		dataType, ok := columnType(field.Type)
+		if !ok {
+			return nil, ErrInvalidTableValue
+		}
+		col.Value = dataType
+
+		if i, ok := keyIndex[col.Key]; ok {
+			// Keys have to be ordered, so JSON can't be part of the key. A hidden rowid can't have a field either
+			if col.Value == app.DBJsonArr || col.Value == app.DBJsonData || rowID {
+				return nil, ErrCreateTableInvalidKey(col.Key)
+			}
+			if col.Key == options.AutoIncrement {
+				if !isIntegerType(field.Type) {
+					return nil, ErrCreateTableInvalidAutoIncrement(col.Key)
+				}
+				col.AutoIncrement = true
+			}
+			// Every row needs a whole primary key
+			col.NotNull = true
+			schema.PrimaryKey[i] = col
+			continue
+		}
+		columns = append(columns, col)
+		colsMap[col.Key] = col.Value
+	}
+	if rowID {
+		schema.PrimaryKey[0] = app.TableColumn{Key: RowIDColumn, Value: app.DBInt, NotNull: true, AutoIncrement: true}
+	}
+	for i, name := range primaryKey {
+		if schema.PrimaryKey[i].Key == "" {
+			return nil, ErrCreateTableInvalidKey(name)
+		}
+	}
+	schema.Columns = columns
+	for _, name := range options.Unique {
+		col := findColumn(schema.PrimaryKey, name)
+		if col == nil {
+			col = findColumn(schema.Columns, name)
+		}
+		// Unique columns are indexed, so they can't be JSON either
+		if col == nil || col.Unique || col.Value == app.DBJsonArr || col.Value == app.DBJsonData {
+			return nil, ErrCreateTableInvalidUnique(name)
+		}
+		col.Unique = true
+	}
+	tree, err := app.CreateBTree(db.pager)
 	if err != nil {
 		return nil, err
 	}
-	for _, schema := range schemas {
-		schema := schema
-		// TODO only find the data that you need. This is too much data
-		// The app layer needs to implement a function to find a value by key and return it
-		// Then the app layer can pass a functor to the
-		if schema.Name != tableName {
+	schema.Root = tree.Root
+	return &tableNode{
+		db:      db,
+		schema:  &schema,
+		columns: colsMap,
+		tree:    tree,
+		dirty:   true,
+	}, nil
+}
+
+// Reads a table and its indexes from a schema table. open opens the B-trees of the table and its indexes.
+// Returns nil if there is no such table.
+func loadTable(db *DB, schemaTree *app.BTree, tableName string, open func(root int) *app.BTree) (*tableNode, error) {
+	schema, err := app.GetSchema(schemaTree, tableName)
+	if err != nil || schema == nil {
+		return nil, schemaError(err)
+	}
+	indexes, err := app.ListIndexes(schemaTree, tableName)
+	if err != nil {
+		return nil, schemaError(err)
+	}
+	tbl := newTableNode(db, schema, open(schema.Root))
+	for i := range indexes {
+		tbl.indexes = append(tbl.indexes, &indexNode{
+			schema: &indexes[i],
+			tree:   open(indexes[i].Root),
+		})
+	}
+	return tbl, nil
+}
+
+func newTableNode(db *DB, schema *app.TableSchema, tree *app.BTree) *tableNode {
+	return &tableNode{
+		db:      db,
+		schema:  schema,
+		tree:    tree,
+		columns: columnsMap(schema),
+	}
+}
+
+// Maps the names of the columns that aren't part of the primary key to their types. Dropped columns are left out
+func columnsMap(schema *app.TableSchema) map[string]app.DataType {
+	colsMap := make(map[string]app.DataType)
+	for _, col := range schema.LiveColumns() {
+		colsMap[col.Key] = col.Value
+	}
+	return colsMap
+}
+
+// Represents the table and its data
+// This is an in-memory representation. On disk, the headers and data
+// are stored in different locations
+type tableNode struct {
+	db      *DB
+	schema  *app.TableSchema
+	tree    *app.BTree
+	columns map[string]app.DataType
+	indexes []*indexNode
+	// Whether the schema has changed since it was last written to the schema table
+	dirty bool
+}
+
+// A secondary index of a table
+type indexNode struct {
+	schema *app.IndexSchema
+	tree   *app.BTree
+	// Whether the schema has changed since it was last written to the schema table
+	dirty bool
+}
+
+// Records the root of the index's tree in its schema
+func (idx *indexNode) syncRoot() {
+	if idx.schema.Root != idx.tree.Root {
+		idx.schema.Root = idx.tree.Root
+		idx.dirty = true
+	}
+}
+
+// Looks up a column of the table by name, including the primary key columns
+func (tbl *tableNode) column(name string) (app.TableColumn, bool) {
+	col := findColumn(tbl.schema.PrimaryKey, name)
+	if col == nil {
+		col = findColumn(tbl.schema.Columns, name)
+	}
+	if col == nil {
+		return app.TableColumn{}, false
+	}
+	return *col, true
+}
+
+// Returns nil if there's no column called name. Dropped columns are skipped
+func findColumn(cols []app.TableColumn, name string) *app.TableColumn {
+	for i := range cols {
+		if cols[i].Key == name && !cols[i].Dropped {
+			return &cols[i]
+		}
+	}
+	return nil
+}
+
+// Looks up an index of the table by name. Returns nil if the table has no such index.
+func (tbl *tableNode) index(name string) *indexNode {
+	for _, idx := range tbl.indexes {
+		if idx.schema.Name == name {
+			return idx
+		}
+	}
+	return nil
+}
+
+// Checks that no other row has the same values as row in a unique index of the table.
+// primaryKey is the encoded primary key of row, which may already be in the table.
+func (tbl *tableNode) checkUnique(row *app.TableKeyValue, primaryKey []byte) error {
+	for _, idx := range tbl.indexes {
+		if !idx.schema.Unique {
+			continue
+		}
+		if idx.schema.HasNull(row) {
+			// Like in SQL, NULL isn't equal to anything, so rows can share it
 			continue
 		}
-		tblNode := tableNode{
-			db:     db,
-			schema: &schema,
+		key, err := idx.schema.EncodeKey(row, primaryKey)
+		if err != nil {
+			return err
 		}
-		// generate the columns array
-		colsMap := make(map[string]app.DataType)
-		for _, col := range schema.Columns {
-			colsMap[col.Key] = col.Value
+		vals := key[:len(key)-len(primaryKey)]
+		conflict, err := hasOtherKey(idx.tree, vals, primaryKey)
+		if err != nil {
+			return err
+		}
+		if conflict {
+			col := idx.schema.Columns[0].Key
+			val, ok := row.Key[col]
+			if !ok {
+				val = row.Val[col]
+			}
+			return &UniqueConstraintError{Table: tbl.schema.Name, Column: col, Value: val}
 		}
-		tblNode.columns = colsMap
-		// deserialize data root page
-		rootPage, err := db.pager.Request(schema.Root)
+	}
+	return nil
+}
+
+// Whether the index has a key that starts with vals, other than the key of the row with primaryKey
+func hasOtherKey(tree *app.BTree, vals []byte, primaryKey []byte) (bool, error) {
+	c := tree.Cursor()
+	defer c.Close()
+	ok, err := c.Seek(vals)
+	for ; ok; ok, err = c.Next() {
+		key, err := c.Key()
 		if err != nil {
-			return nil, err
+			return false, err
+		}
+		if !bytes.HasPrefix(key, vals) {
+			return false, nil
 		}
-		defer rootPage.Done()
-		tblNode.root = &app.LeafNode{
-			ID:       schema.Root,
-			PageSize: int(db.header.PageSize),
-			Data:     make([]app.TableKeyValue, 0),
-			Headers:  &schema,
-			Pager:    db.pager,
+		if !bytes.Equal(key[len(vals):], primaryKey) {
+			return true, nil
 		}
-		return &tblNode, nil
 	}
-	return nil, nil
+	return false, err
 }
 
-func (db *DB) Insert(
-	tableName string,
-	val interface{},
-) error {
-	table, err := db.lookupTable(tableName)
-	if table == nil {
-		return ErrUnknownTableName
+// Adds a row to every index of the table. primaryKey is the encoded primary key of the row.
+func (tbl *tableNode) insertIndexKeys(row *app.TableKeyValue, primaryKey []byte) error {
+	for _, idx := range tbl.indexes {
+		key, err := idx.schema.EncodeKey(row, primaryKey)
+		if err != nil {
+			return err
+		}
+		err = idx.tree.Insert(&app.KeyValue{Key: key})
+		if err != nil {
+			return err
+		}
+		idx.syncRoot()
+	}
+	return nil
+}
+
+// Looks up the row with the given primary key, e.g. before it is changed. Returns nil if there is no such row.
+func (tbl *tableNode) lookupRow(primaryKey []byte) (*app.TableKeyValue, error) {
+	val, found, err := tbl.tree.Get(primaryKey)
+	if err != nil || !found {
+		return nil, err
+	}
+	return app.DecodeKeyValue(tbl.schema, &app.KeyValue{Key: primaryKey, Val: val})
+}
+
+// Removes a row from every index of the table, before the row itself is changed.
+// The old row is needed to find its keys in the indexes. primaryKey is the encoded primary key of the row.
+func (tbl *tableNode) deleteIndexKeys(row *app.TableKeyValue, primaryKey []byte) error {
+	for _, idx := range tbl.indexes {
+		key, err := idx.schema.EncodeKey(row, primaryKey)
+		if err != nil {
+			return err
+		}
+		_, err = idx.tree.Delete(key)
+		if err != nil {
+			return err
+		}
+		idx.syncRoot()
 	}
+	return nil
+}
+
+func (tbl *tableNode) isPrimaryKey(name string) bool {
+	for _, col := range tbl.schema.PrimaryKey {
+		if col.Key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches up the values of a primary key with the primary key columns
+func (tbl *tableNode) keyColumns(key interface{}) (map[string]interface{}, error) {
+	vals, ok := key.(Key)
+	if !ok {
+		vals = Key{key}
+	}
+	if len(vals) != len(tbl.schema.PrimaryKey) {
+		return nil, ErrKeyMismatch
+	}
+	vals, err := tbl.convertKey(tbl.schema.PrimaryKey, vals)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	cols := make(map[string]interface{}, len(vals))
+	for i, col := range tbl.schema.PrimaryKey {
+		cols[col.Key] = vals[i]
 	}
+	return cols, nil
+}
 
+// Encodes val, which is a struct or a pointer to one, as a row of the table. Returns both the columns of the row, and their encoding.
+// If the table has an autoincrementing key and val has no value for it, the row is given the next ID if assignID is set,
+// and is an error otherwise.
+func (tbl *tableNode) encodeRow(val interface{}, assignID bool) (*app.TableKeyValue, *app.KeyValue, error) {
 	// Iterate over the fields of the val struct, verifying that
-	// 1. the primary key exists
-	// 2. the column names are a subset of the known column names. The object shouldn't have any extra exported fields
+	// 1. all the primary key columns exist
+	// 2. the column names are a subset of the known column names. The object shouldn't have any extra exported fields,
+	//    other than the ones that are skipped with a "-" tag
 	// It's a design choice here, but I choose to return an error if val contains extra fields, this helps identify bugs quickly
 	// You could easily choose to silently ignore extra fields. Or even encode them as extra "slop" data. Honestly, that last one might be better,
 	// since it allows for easy extensibility. I've definitely worked on a project where fields were just slapped onto the User struct without much thought
 
-	v := reflect.ValueOf(val)
 	typ := reflect.TypeOf(val)
+	v := reflect.ValueOf(val)
+	if isStructPointer(val) {
+		typ = typ.Elem()
+		v = v.Elem()
+	}
+	fieldCols, err := fieldColumns(typ)
+	if err != nil {
+		return nil, nil, err
+	}
 	data := app.NewTableKeyValue()
-	var foundPrimary bool
-
-	for i := 0; i < v.NumField(); i++ {
-		field := v.Field(i)
-		fieldName := typ.Field(i).Name
-		// feat: multi primary key
-		if fieldName == table.schema.PrimaryKey[0].Key {
-			data.Key[fieldName] = field.Interface()
-			foundPrimary = true
-			continue
-		}
+	autoKey := tbl.schema.AutoIncrementKey()
+	// The field that holds the autoincrementing key, if val has one
+	var idField reflect.Value
 
-		if _, ok := table.columns[fieldName]; ok {
-			fieldVal := field.Interface()
-			// TODO check value
-			data.Val[fieldName] = fieldVal
+	for i := range fieldCols {
+		fieldCol := &fieldCols[i]
+		field := v.Field(fieldCol.field)
+		name := fieldCol.name
+		col, ok := tbl.column(name)
+		if !ok {
+			return nil, nil, ErrInsertInvalidKey(name)
+		}
+		fieldVal, err := fieldCol.value(field)
+		if err != nil {
+			return nil, nil, err
+		}
+		if autoKey != nil && name == autoKey.Key {
+			idField = field
+			// A nil pointer, or one to 0, is unset too
+			if id, _ := convertValue(col.Value, fieldVal); id == nil || id == int64(0) {
+				// Gets the next ID below
+				continue
+			}
+		}
+		if fieldVal == nil && col.NotNull {
+			return nil, nil, &NotNullConstraintError{Table: tbl.schema.Name, Column: name}
+		}
+		fieldVal, ok = convertValue(col.Value, fieldVal)
+		if !ok {
+			return nil, nil, &ColumnTypeError{Table: tbl.schema.Name, Column: name, Expected: col.Value, Actual: field.Type()}
+		}
+		if tbl.isPrimaryKey(name) {
+			data.Key[name] = fieldVal
 		} else {
-			return ErrInsertInvalidKey(fieldName)
+			data.Val[name] = fieldVal
+		}
+	}
+	if autoKey != nil {
+		err = tbl.autoIncrement(&data, autoKey.Key, idField, assignID)
+		if err != nil {
+			return nil, nil, err
 		}
 	}
-	if !foundPrimary {
-		return ErrInsertNoPrimaryKey
+	if len(data.Key) != len(tbl.schema.PrimaryKey) {
+		return nil, nil, ErrInsertNoPrimaryKey
 	}
-	// append
-	table.root.Data = append(table.root.Data, data)
+	// Columns that val has no field for are NULL
+	for _, col := range tbl.schema.Columns {
+		if _, ok := data.Val[col.Key]; !ok && col.NotNull && !col.Dropped {
+			return nil, nil, &NotNullConstraintError{Table: tbl.schema.Name, Column: col.Key}
+		}
+	}
+	kv, err := app.EncodeKeyValue(tbl.schema, &data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &data, kv, nil
+}
 
+// Gives a row without a value for the autoincrementing key the next ID of the table, if assignID is set.
+// A row that has a value moves the sequence past it, so that the value is never handed out.
+// idField is the field of the inserted struct that holds the key, if it has one.
+func (tbl *tableNode) autoIncrement(row *app.TableKeyValue, key string, idField reflect.Value, assignID bool) error {
+	if val, ok := row.Key[key]; ok {
+		if id, ok := val.(int64); ok && id > tbl.schema.Sequence {
+			tbl.schema.Sequence = id
+			tbl.dirty = true
+		}
+		return nil
+	}
+	if !assignID {
+		return nil
+	}
+	if tbl.schema.Sequence == math.MaxInt64 {
+		return ErrSequenceExhausted
+	}
+	id := tbl.schema.Sequence + 1
+	if idField.IsValid() {
+		// The ID is written back into the field once the row is inserted, so it has to fit
+		err := setField(reflect.New(idField.Type()).Elem(), id)
+		if err != nil {
+			return fmt.Errorf("insert: column %s: %w", key, err)
+		}
+	}
+	// Like sqlite's AUTOINCREMENT, the IDs of inserts that fail afterwards are skipped
+	tbl.schema.Sequence = id
+	tbl.dirty = true
+	row.Key[key] = id
 	return nil
 }
 
-// Temp function until we do something better
-func (db *DB) SyncAll() error {
-	pagerInfo, err := db.tables["Bars"].root.EncodeDataAsPage()
+// Writes the autoincrementing key of an inserted row back into val, if val is a pointer to a struct with a field for it.
+// Returns the key, or 0 if the table has no autoincrementing key.
+func (tbl *tableNode) writeID(val interface{}, row *app.TableKeyValue) (int64, error) {
+	autoKey := tbl.schema.AutoIncrementKey()
+	if autoKey == nil {
+		return 0, nil
+	}
+	id, _ := row.Key[autoKey.Key].(int64)
+	if !isStructPointer(val) {
+		return id, nil
+	}
+	v := reflect.ValueOf(val).Elem()
+	fieldCols, err := fieldColumns(v.Type())
 	if err != nil {
-		return err
+		return 0, err
+	}
+	for _, fieldCol := range fieldCols {
+		if fieldCol.name == autoKey.Key {
+			return id, setField(v.Field(fieldCol.field), id)
+		}
 	}
-	err = db.pager.WritePage(pagerInfo)
+	return id, nil
+}
+
+// Fills in dest, which must be a pointer to a struct, with a row of the table
+func (tbl *tableNode) decodeRow(kv *app.KeyValue, dest interface{}) error {
+	row, err := app.DecodeKeyValue(tbl.schema, kv)
 	if err != nil {
 		return err
 	}
 
-	tablePagerInfo, err := db.marshalSchemaAsPage()
+	// The same rules as Insert: every field that isn't skipped must be a column of the table
+	v := reflect.ValueOf(dest).Elem()
+	fieldCols, err := fieldColumns(v.Type())
 	if err != nil {
 		return err
 	}
-	err = db.pager.WritePage(tablePagerInfo)
+	for _, fieldCol := range fieldCols {
+		name := fieldCol.name
+		var colVal interface{}
+		if tbl.isPrimaryKey(name) {
+			colVal = row.Key[name]
+		} else if _, ok := tbl.columns[name]; ok {
+			colVal = row.Val[name]
+		} else {
+			return ErrGetInvalidKey(name)
+		}
+		err = setField(v.Field(fieldCol.field), colVal)
+		if err != nil {
+			return fmt.Errorf("get: column %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Fills in the fields of dest for the given columns of a row, and leaves its other fields alone.
+// As with decodeRow, every field must be a column of the table.
+func (tbl *tableNode) setColumns(names []string, vals []interface{}, dest interface{}) error {
+	v := reflect.ValueOf(dest).Elem()
+	fieldCols, err := fieldColumns(v.Type())
 	if err != nil {
 		return err
 	}
+	for _, fieldCol := range fieldCols {
+		name := fieldCol.name
+		if _, ok := tbl.column(name); !ok {
+			return ErrGetInvalidKey(name)
+		}
+		for i := range names {
+			if names[i] != name {
+				continue
+			}
+			err = setField(v.Field(fieldCol.field), vals[i])
+			if err != nil {
+				return fmt.Errorf("get: column %s: %w", name, err)
+			}
+			break
+		}
+	}
+	return nil
+}
 
-	return db.file.Sync()
+func isStructPointer(dest interface{}) bool {
+	ptr := reflect.ValueOf(dest)
+	return ptr.Kind() == reflect.Pointer && !ptr.IsNil() && ptr.Elem().Kind() == reflect.Struct
 }
 
-func (db *DB) marshalSchemaAsPage() (app.PagerInfo, error) {
-	schemas := make([]*app.TableSchema, 0, len(db.tables))
-	for _, tbl := range db.tables {
-		schemas = append(schemas, tbl.schema)
+// Records the root of the table's tree in its schema, since splitting or shrinking the tree moves the root
+func (tbl *tableNode) syncRoot() {
+	if tbl.schema.Root != tbl.tree.Root {
+		tbl.schema.Root = tbl.tree.Root
+		tbl.dirty = true
 	}
-	node := app.NewSchemaPage(schemas, int(db.header.PageSize), db.pager, &db.header)
-	return node.EncodeDataAsPage()
 }
 
-// Uses reflection to figure out what fields are available on a struct
-func (db *DB) createTable(tableName string, tableType interface{}, primaryKey string) (*tableNode, error) {
-	schema := app.TableSchema{
-		Name:       tableName,
-		PrimaryKey: make([]app.TableColumn, 1),
-		Root:       db.pager.NextFreePageID(),
+// Encodes the values of the first few primary key columns
+func (tbl *tableNode) keyPrefix(key interface{}) ([]byte, error) {
+	vals, ok := key.(Key)
+	if !ok {
+		vals = Key{key}
 	}
-	// feat: multi primary key
-	schema.PrimaryKey[0] = app.TableColumn{
-		Key:   primaryKey,
-		Value: app.DBStr,
+	if len(vals) == 0 || len(vals) > len(tbl.schema.PrimaryKey) {
+		return nil, ErrKeyMismatch
 	}
+	vals, err := tbl.convertKey(tbl.schema.PrimaryKey, vals)
+	if err != nil {
+		return nil, err
+	}
+	return app.EncodeKeyPrefix(tbl.schema, vals)
+}
 
-	cols := make([]app.TableColumn, 0)
-	colsMap := make(map[string]app.DataType)
-
-	typ := reflect.TypeOf(tableType)
-	for _, field := range reflect.VisibleFields(typ) {
-		col := app.TableColumn{Key: field.Name}
-
-		switch field.Type.Kind() {
-		case reflect.Bool,
-			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
-			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			col.Value = app.DBInt
-		case reflect.Float32, reflect.Float64:
-			col.Value = app.DBReal
-		case reflect.String:
-			col.Value = app.DBStr
-		case reflect.Slice:
-			elem := field.Type.Elem()
-			switch elem.Kind() {
-			case reflect.Uint8:
-				col.Value = app.DBBlob
-			default:
-				col.Value = app.DBJsonArr
-			}
-		case reflect.Map:
-			col.Value = app.DBJsonData
-		default:
-			return nil, ErrInvalidTableValue
-		}
-
-		// feat: multi primary key
-		if col.Key != primaryKey {
-			cols = append(cols, col)
-			colsMap[col.Key] = col.Value
+// Converts the values of a key to the types that cols store, the same way that Insert converts the values of a row.
+// Otherwise a value of another type, e.g. an int for a DBReal column, would be encoded differently and never match.
+func (tbl *tableNode) convertKey(cols []app.TableColumn, vals Key) (Key, error) {
+	converted := make(Key, len(vals))
+	for i, val := range vals {
+		col := cols[i]
+		v, ok := convertValue(col.Value, val)
+		if !ok {
+			return nil, &ColumnTypeError{Table: tbl.schema.Name, Column: col.Key, Expected: col.Value, Actual: reflect.TypeOf(val)}
 		}
+		converted[i] = v
 	}
-	schema.Columns = cols
-	return &tableNode{
-		db:      db,
-		schema:  &schema,
-		columns: colsMap,
-		root: &app.LeafNode{
-			ID:       schema.Root,
-			PageSize: int(db.header.PageSize),
-			Headers:  &schema,
-			Pager:    db.pager,
-		},
-	}, nil
+	return converted, nil
 }
 
-// Represents the table and its data
-// This is an in-memory representation. On disk, the headers and data
-// are stored in different locations
-type tableNode struct {
-	db      *DB
-	schema  *app.TableSchema
-	root    *app.LeafNode
-	columns map[string]app.DataType
-}
+// A primary key with more than one column. The values are in the same order as
+// the primary key columns that were given to CreateTable.
+type Key []interface{}
@@ -0,0 +1,146 @@
+package rashdb
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// How a struct field maps onto a column of a table, as set by its struct tag. See DB.CreateTable for the tag format.
+// Unexported fields and fields tagged "-" have no column.
+type fieldColumn struct {
+	name string
+	// The index of the field in its struct
+	field     int
+	pk        bool
+	omitEmpty bool
+	notNull   bool
+	index     bool
+	unique    bool
+	// Implies pk
+	autoIncrement bool
+}
+
+const tagName = "rashdb"
+
+// Parsing tags is done once per type, since every insert needs them
+var fieldColumnsCache sync.Map // map[reflect.Type]fieldColumnsResult
+
+type fieldColumnsResult struct {
+	cols []fieldColumn
+	err  error
+}
+
+// Lists the columns that the fields of a struct type map onto, in field order
+func fieldColumns(typ reflect.Type) ([]fieldColumn, error) {
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return nil, ErrInvalidTableValue
+	}
+	if res, ok := fieldColumnsCache.Load(typ); ok {
+		res := res.(fieldColumnsResult)
+		return res.cols, res.err
+	}
+	cols, err := parseFieldColumns(typ)
+	fieldColumnsCache.Store(typ, fieldColumnsResult{cols: cols, err: err})
+	return cols, err
+}
+
+func parseFieldColumns(typ reflect.Type) ([]fieldColumn, error) {
+	cols := make([]fieldColumn, 0, typ.NumField())
+	names := make(map[string]bool, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get(tagName)
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		col := fieldColumn{name: name, field: i}
+		if col.name == "" {
+			col.name = field.Name
+		}
+		for opts != "" {
+			var opt string
+			opt, opts, _ = strings.Cut(opts, ",")
+			switch opt {
+			case "pk":
+				col.pk = true
+			case "omitempty":
+				col.omitEmpty = true
+			case "notnull":
+				col.notNull = true
+			case "index":
+				col.index = true
+			case "unique":
+				col.unique = true
+			case "autoincrement":
+				col.pk = true
+				col.autoIncrement = true
+			default:
+				return nil, ErrInvalidStructTag(field.Name, opt)
+			}
+		}
+		if names[col.name] {
+			return nil, ErrDuplicateColumn(col.name)
+		}
+		names[col.name] = true
+		cols = append(cols, col)
+	}
+	return cols, nil
+}
+
+// The value that is stored for a field, or nil for NULL
+func (col *fieldColumn) value(field reflect.Value) (interface{}, error) {
+	if col.omitEmpty && field.IsZero() {
+		return nil, nil
+	}
+	return fieldValue(field)
+}
+
+// Adds the primary key, autoincrementing, unique and indexed columns that are declared in struct tags to the options.
+// The primary key can be given either in the options or in tags, but not both.
+func (options *TableOptions) withTags(cols []fieldColumn) (*TableOptions, error) {
+	merged := TableOptions{
+		PrimaryKey:    options.PrimaryKey,
+		AutoIncrement: options.AutoIncrement,
+		Unique:        append([]string(nil), options.Unique...),
+		Index:         append([]string(nil), options.Index...),
+	}
+	var taggedKey []string
+	for _, col := range cols {
+		if col.pk {
+			taggedKey = append(taggedKey, col.name)
+		}
+		if col.autoIncrement {
+			if merged.AutoIncrement != "" && merged.AutoIncrement != col.name {
+				return nil, ErrCreateTableInvalidAutoIncrement(col.name)
+			}
+			merged.AutoIncrement = col.name
+		}
+		if col.unique && !containsString(merged.Unique, col.name) {
+			merged.Unique = append(merged.Unique, col.name)
+		}
+		if col.index && !containsString(merged.Index, col.name) {
+			merged.Index = append(merged.Index, col.name)
+		}
+	}
+	if len(taggedKey) > 0 {
+		if len(merged.PrimaryKey) > 0 {
+			return nil, ErrPrimaryKeyTwice
+		}
+		merged.PrimaryKey = taggedKey
+	}
+	return &merged, nil
+}
+
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,745 @@
+package rashdb
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/thomastay/rash-db/pkg/app"
+)
+
+// A transaction. Read-only transactions can only look rows up, while writable transactions can also change them.
+// There is at most one writable transaction at a time.
+// Every transaction must end with either Commit or Rollback.
+//
+// Read-only transactions see the DB as of the last commit before they started, for as long as they are open.
+// They can run on any goroutine, at the same time as the writer, and never block it.
+type Tx struct {
+	db       *DB
+	writable bool
+	// Set for the transaction that DB.Insert and friends use, which SyncAll commits
+	implicit bool
+	done     bool
+
+	// Only for read-only transactions. The version of the DB that they read
+	snapshot *app.Snapshot
+	// The schema table, as of the snapshot
+	schema *app.BTree
+	// Tables that have been looked up, as of the snapshot
+	tables map[string]*tableNode
+
+	// Closed when the transaction ends
+	cursors []*Cursor
+}
+
+// Starts a transaction. Only one writable transaction can be open at a time, and
+// changes made outside of a transaction have to be committed with SyncAll before starting one.
+func (db *DB) Begin(writable bool) (*Tx, error) {
+	tx := &Tx{db: db, writable: writable}
+	if writable {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if db.writer != nil {
+			return nil, ErrTxInProgress
+		}
+		db.writer = tx
+		return tx, nil
+	}
+	snapshot, err := db.pager.BeginRead()
+	if err != nil {
+		return nil, err
+	}
+	tx.snapshot = snapshot
+	tx.schema = snapshot.OpenBTree(app.DBSchemaPageID)
+	tx.tables = make(map[string]*tableNode)
+	return tx, nil
+}
+
+// Runs fn inside a writable transaction. The transaction is committed if fn returns nil,
+// and rolled back otherwise.
+func (db *DB) Update(fn func(*Tx) error) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	// Rolls back if fn panics
+	defer func() {
+		if !tx.done {
+			tx.Rollback()
+		}
+	}()
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Runs fn inside a read-only transaction
+func (db *DB) View(fn func(*Tx) error) error {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return fn(tx)
+}
+
+// Runs fn in the transaction that changes made directly on the DB go into, starting it if there isn't one.
+// Only one goroutine at a time uses the transaction.
+func (db *DB) implicitUpdate(fn func(*Tx) error) error {
+	db.implicitMu.Lock()
+	defer db.implicitMu.Unlock()
+	tx, err := db.implicitTx()
+	if err != nil {
+		return err
+	}
+	return fn(tx)
+}
+
+// Runs fn in the implicit transaction if there is one, so that it sees changes that haven't been synced yet.
+// Otherwise, fn runs in a read-only transaction.
+func (db *DB) implicitView(fn func(*Tx) error) error {
+	db.implicitMu.Lock()
+	db.mu.Lock()
+	writer := db.writer
+	db.mu.Unlock()
+	if writer == nil || !writer.implicit {
+		db.implicitMu.Unlock()
+		return db.View(fn)
+	}
+	defer db.implicitMu.Unlock()
+	return fn(writer)
+}
+
+// The transaction that changes made directly on the DB go into. implicitMu must be held
+func (db *DB) implicitTx() (*Tx, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.writer == nil {
+		db.writer = &Tx{db: db, writable: true, implicit: true}
+	}
+	if !db.writer.implicit {
+		return nil, ErrTxInProgress
+	}
+	return db.writer, nil
+}
+
+func (tx *Tx) checkWritable() error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	return nil
+}
+
+// Writes every change made in the transaction to the write-ahead log, and ends the transaction.
+// If the changes can't be written, the transaction is rolled back.
+func (tx *Tx) Commit() error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	err := tx.commit()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.close()
+	return nil
+}
+
+func (tx *Tx) commit() error {
+	db := tx.db
+	// The schemas of tables that have changed go into the schema table first,
+	// since they dirty its pages too
+	for _, tbl := range db.tables {
+		if tbl.dirty {
+			err := app.PutSchema(db.schema, tbl.schema)
+			if err != nil {
+				return err
+			}
+			tbl.dirty = false
+		}
+		for _, idx := range tbl.indexes {
+			if !idx.dirty {
+				continue
+			}
+			err := app.PutIndex(db.schema, idx.schema)
+			if err != nil {
+				return err
+			}
+			idx.dirty = false
+		}
+	}
+	return db.pager.Flush()
+}
+
+// Throws away every change made in the transaction, and ends it.
+// Read-only transactions are always ended with Rollback.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if tx.writable {
+		tx.db.pager.Rollback()
+		// Tables that were created or changed are read back from the schema table
+		tx.db.tables = make(map[string]*tableNode)
+	} else {
+		tx.snapshot.Close()
+	}
+	tx.close()
+	return nil
+}
+
+func (tx *Tx) close() {
+	tx.done = true
+	for _, c := range tx.cursors {
+		c.Close()
+	}
+	tx.cursors = nil
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if tx.db.writer == tx {
+		tx.db.writer = nil
+	}
+}
+
+// Looks the table up as the transaction sees it. Returns nil if it cannot find it.
+func (tx *Tx) lookupTable(tableName string) (*tableNode, error) {
+	if tx.writable {
+		return tx.db.lookupTable(tableName)
+	}
+	if tbl, ok := tx.tables[tableName]; ok {
+		return tbl, nil
+	}
+	tbl, err := loadTable(tx.db, tx.schema, tableName, tx.snapshot.OpenBTree)
+	if err != nil || tbl == nil {
+		return nil, err
+	}
+	tx.tables[tableName] = tbl
+	return tbl, nil
+}
+
+// Creates a table whose columns are the fields of tableType.
+// The primary key is made up of one or more of those columns, and rows are ordered by the primary key columns,
+// in the order they're given here. See DB.CreateTable for the struct tags that tableType may use, and for tables
+// without a primary key.
+func (tx *Tx) CreateTable(
+	tableName string,
+	tableType interface{},
+	primaryKey ...string,
+) error {
+	return tx.CreateTableWithOptions(tableName, tableType, &TableOptions{PrimaryKey: primaryKey})
+}
+
+// Creates a table whose columns are the fields of tableType, with the given options
+func (tx *Tx) CreateTableWithOptions(
+	tableName string,
+	tableType interface{},
+	options *TableOptions,
+) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	if options == nil {
+		// The primary key may still be in the struct tags
+		options = &TableOptions{}
+	}
+	// Tables and indexes share names
+	exists, err := tx.db.nameExists(tableName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrTableExists
+	}
+	typ := reflect.TypeOf(tableType)
+	cols, err := fieldColumns(typ)
+	if err != nil {
+		return err
+	}
+	options, err = options.withTags(cols)
+	if err != nil {
+		return err
+	}
+	tbl, err := tx.db.createTable(tableName, typ, cols, options)
+	if err != nil {
+		return err
+	}
+	for _, name := range options.Unique {
+		col, _ := tbl.column(name)
+		err = tx.createIndex(tbl, uniqueIndexName(tableName, name), []app.TableColumn{col}, true)
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range options.Index {
+		if col, ok := tbl.column(name); ok && col.Unique {
+			// Already has a unique index
+			continue
+		}
+		indexCols, err := tbl.indexColumns([]string{name})
+		if err != nil {
+			return err
+		}
+		err = tx.createIndex(tbl, columnIndexName(tableName, name), indexCols, false)
+		if err != nil {
+			return err
+		}
+	}
+	tx.db.tables[tableName] = tbl
+	return nil
+}
+
+// Deletes a table and its indexes, and frees all of their pages.
+// Cursors that are open on the table can't be used afterwards.
+func (tx *Tx) DropTable(tableName string) error {
+	table, err := tx.writableTable(tableName)
+	if err != nil {
+		return err
+	}
+	for _, idx := range table.indexes {
+		err = idx.tree.Drop()
+		if err != nil {
+			return err
+		}
+		// Tables and indexes that were created in this transaction don't have a schema row yet
+		_, err = app.DeleteSchema(tx.db.schema, idx.schema.Name)
+		if err != nil {
+			return err
+		}
+	}
+	err = table.tree.Drop()
+	if err != nil {
+		return err
+	}
+	_, err = app.DeleteSchema(tx.db.schema, tableName)
+	if err != nil {
+		return err
+	}
+	delete(tx.db.tables, tableName)
+	return nil
+}
+
+// Renames a table. The indexes that were created for its unique and indexed columns are renamed with it.
+func (tx *Tx) RenameTable(oldName string, newName string) error {
+	table, err := tx.writableTable(oldName)
+	if err != nil {
+		return err
+	}
+	exists, err := tx.db.nameExists(newName)
+	if err != nil {
+		return err
+	}
+	if exists || newName == "" {
+		return ErrTableExists
+	}
+	// Check every new name before changing anything
+	indexNames, err := tx.generatedIndexNames(table, newName, "", "")
+	if err != nil {
+		return err
+	}
+	err = tx.renameIndexes(table, indexNames)
+	if err != nil {
+		return err
+	}
+	for _, idx := range table.indexes {
+		idx.schema.Table = newName
+		idx.dirty = true
+	}
+	// The schema rows are keyed by name, so the old row goes and a new one is written on commit
+	_, err = app.DeleteSchema(tx.db.schema, oldName)
+	if err != nil {
+		return err
+	}
+	table.schema.Name = newName
+	table.dirty = true
+	delete(tx.db.tables, oldName)
+	tx.db.tables[newName] = table
+	return nil
+}
+
+// Works out the names that the generated indexes of a table get when the table is renamed to newTable, or when its
+// column oldColumn is renamed to newColumn. The other indexes keep their names.
+// Returns ErrIndexExists if a new name is already taken.
+func (tx *Tx) generatedIndexNames(table *tableNode, newTable string, oldColumn string, newColumn string) ([]string, error) {
+	oldTable := table.schema.Name
+	names := make([]string, len(table.indexes))
+	for i, idx := range table.indexes {
+		names[i] = idx.schema.Name
+		if len(idx.schema.Columns) != 1 {
+			continue
+		}
+		col := idx.schema.Columns[0].Key
+		newCol := col
+		if col == oldColumn {
+			newCol = newColumn
+		}
+		switch idx.schema.Name {
+		case uniqueIndexName(oldTable, col):
+			names[i] = uniqueIndexName(newTable, newCol)
+		case columnIndexName(oldTable, col):
+			names[i] = columnIndexName(newTable, newCol)
+		}
+		if names[i] == idx.schema.Name {
+			continue
+		}
+		exists, err := tx.db.nameExists(names[i])
+		if err != nil {
+			return nil, err
+		}
+		if exists || containsString(names[:i], names[i]) {
+			return nil, ErrIndexExists
+		}
+	}
+	return names, nil
+}
+
+// Gives the indexes of a table the names from generatedIndexNames.
+// The schema rows are keyed by name, so the old rows go and new ones are written on commit
+func (tx *Tx) renameIndexes(table *tableNode, names []string) error {
+	for i, idx := range table.indexes {
+		if names[i] == idx.schema.Name {
+			continue
+		}
+		_, err := app.DeleteSchema(tx.db.schema, idx.schema.Name)
+		if err != nil {
+			return err
+		}
+		idx.schema.Name = names[i]
+		idx.dirty = true
+	}
+	return nil
+}
+
+// The name of the index that enforces a unique column
+func uniqueIndexName(tableName string, column string) string {
+	return fmt.Sprintf("rashdb_unique_%s_%s", tableName, column)
+}
+
+// The name of the index that a column gets from TableOptions.Index
+func columnIndexName(tableName string, column string) string {
+	return fmt.Sprintf("rashdb_index_%s_%s", tableName, column)
+}
+
+// Creates an index called indexName on the given columns of a table, which makes it fast to find rows by those columns
+// with GetByIndex and IndexCursor. The index is kept up to date as rows are inserted, updated and deleted.
+func (tx *Tx) CreateIndex(tableName string, indexName string, columns ...string) error {
+	table, err := tx.writableTable(tableName)
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return ErrNoIndexColumns
+	}
+	cols, err := table.indexColumns(columns)
+	if err != nil {
+		return err
+	}
+	return tx.createIndex(table, indexName, cols, false)
+}
+
+// Looks up the columns of a new index
+func (tbl *tableNode) indexColumns(columns []string) ([]app.TableColumn, error) {
+	cols := make([]app.TableColumn, len(columns))
+	for i, name := range columns {
+		col, ok := tbl.column(name)
+		// Index keys have to be ordered, so JSON can't be indexed
+		if !ok || col.Value == app.DBJsonArr || col.Value == app.DBJsonData {
+			return nil, ErrCreateIndexInvalidColumn(name)
+		}
+		for _, prev := range cols[:i] {
+			if prev.Key == name {
+				return nil, ErrCreateIndexInvalidColumn(name)
+			}
+		}
+		cols[i] = col
+	}
+	return cols, nil
+}
+
+// Creates an index and fills it with every row of the table
+func (tx *Tx) createIndex(table *tableNode, indexName string, cols []app.TableColumn, unique bool) error {
+	exists, err := tx.db.nameExists(indexName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrIndexExists
+	}
+	tree, err := app.CreateBTree(tx.db.pager)
+	if err != nil {
+		return err
+	}
+	schema := app.IndexSchema{
+		Name:    indexName,
+		Table:   table.schema.Name,
+		Root:    tree.Root,
+		Columns: cols,
+		Unique:  unique,
+	}
+	idx := &indexNode{schema: &schema, tree: tree, dirty: true}
+
+	// Every existing row goes into the index
+	err = table.tree.ForEach(func(kv *app.KeyValue) error {
+		row, err := app.DecodeKeyValue(table.schema, kv)
+		if err != nil {
+			return err
+		}
+		key, err := schema.EncodeKey(row, kv.Key)
+		if err != nil {
+			return err
+		}
+		return idx.tree.Insert(&app.KeyValue{Key: key})
+	})
+	if err != nil {
+		return err
+	}
+	idx.syncRoot()
+	table.indexes = append(table.indexes, idx)
+	return nil
+}
+
+// Looks up a table that the transaction is about to change
+func (tx *Tx) writableTable(tableName string) (*tableNode, error) {
+	if err := tx.checkWritable(); err != nil {
+		return nil, err
+	}
+	table, err := tx.lookupTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	if table == nil {
+		return nil, ErrUnknownTableName
+	}
+	return table, nil
+}
+
+// Inserts val as a new row of the table. val must be a struct of the same type that the table was created with,
+// or a pointer to one.
+//
+// If the table has an autoincrementing key, Insert returns the ID of the row. A row inserted with a zero or nil ID
+// is given the next ID, which is also written into val if it is a pointer. For other tables, the ID is 0.
+func (tx *Tx) Insert(
+	tableName string,
+	val interface{},
+) (int64, error) {
+	table, err := tx.writableTable(tableName)
+	if err != nil {
+		return 0, err
+	}
+	row, kv, err := table.encodeRow(val, true)
+	if err != nil {
+		return 0, err
+	}
+	// Checked before anything changes, so that a failed insert leaves the table as it was
+	err = table.checkUnique(row, kv.Key)
+	if err != nil {
+		return 0, err
+	}
+	err = table.tree.Insert(kv)
+	if err == app.ErrDuplicateKey {
+		return 0, ErrDuplicateKey
+	}
+	if err != nil {
+		return 0, err
+	}
+	table.syncRoot()
+	err = table.insertIndexKeys(row, kv.Key)
+	if err != nil {
+		return 0, err
+	}
+	return table.writeID(val, row)
+}
+
+// Replaces the row that has the same primary key as val. Returns ErrKeyNotFound if there is no such row.
+// val must be a struct of the same type that the table was created with, or a pointer to one.
+// Rows of tables without a primary key have no field for their key, so they can't be updated.
+func (tx *Tx) Update(
+	tableName string,
+	val interface{},
+) error {
+	table, err := tx.writableTable(tableName)
+	if err != nil {
+		return err
+	}
+	row, kv, err := table.encodeRow(val, false)
+	if err != nil {
+		return err
+	}
+	// Checked before anything changes, so that a failed update leaves the table as it was
+	oldRow, err := table.lookupRow(kv.Key)
+	if err != nil {
+		return err
+	}
+	if oldRow == nil {
+		return ErrKeyNotFound
+	}
+	err = table.checkUnique(row, kv.Key)
+	if err != nil {
+		return err
+	}
+	err = table.deleteIndexKeys(oldRow, kv.Key)
+	if err != nil {
+		return err
+	}
+	_, err = table.tree.Update(kv)
+	if err != nil {
+		return err
+	}
+	table.syncRoot()
+	return table.insertIndexKeys(row, kv.Key)
+}
+
+// Inserts val as a new row of the table, replacing the row that has the same primary key if there is one.
+// val must be a struct of the same type that the table was created with, or a pointer to one.
+// Unlike Insert, val must have a value for an autoincrementing key.
+func (tx *Tx) Upsert(
+	tableName string,
+	val interface{},
+) error {
+	table, err := tx.writableTable(tableName)
+	if err != nil {
+		return err
+	}
+	row, kv, err := table.encodeRow(val, false)
+	if err != nil {
+		return err
+	}
+	// Checked before anything changes, as in Update
+	oldRow, err := table.lookupRow(kv.Key)
+	if err != nil {
+		return err
+	}
+	err = table.checkUnique(row, kv.Key)
+	if err != nil {
+		return err
+	}
+	if oldRow != nil {
+		err = table.deleteIndexKeys(oldRow, kv.Key)
+		if err != nil {
+			return err
+		}
+	}
+	err = table.tree.Upsert(kv)
+	if err != nil {
+		return err
+	}
+	table.syncRoot()
+	return table.insertIndexKeys(row, kv.Key)
+}
+
+// Finds the row with the given primary key, and fills in dest with it.
+// For tables with more than one primary key column, key must be a Key.
+// dest must be a pointer to a struct of the same type that the table was created with.
+func (tx *Tx) Get(
+	tableName string,
+	key interface{},
+	dest interface{},
+) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	table, err := tx.lookupTable(tableName)
+	if err != nil {
+		return err
+	}
+	if table == nil {
+		return ErrUnknownTableName
+	}
+
+	if !isStructPointer(dest) {
+		return ErrGetInvalidDest
+	}
+
+	keyCols, err := table.keyColumns(key)
+	if err != nil {
+		return err
+	}
+	keyBytes, err := app.EncodeKey(table.schema, keyCols)
+	if err != nil {
+		return err
+	}
+	valBytes, found, err := table.tree.Get(keyBytes)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrKeyNotFound
+	}
+	return table.decodeRow(&app.KeyValue{Key: keyBytes, Val: valBytes}, dest)
+}
+
+// Finds the first row, in primary key order, whose indexed columns are equal to key, and fills in dest with it.
+// For indexes on more than one column, key must be a Key. It may have fewer values than there are indexed columns,
+// in which case only those columns have to be equal.
+// dest must be a pointer to a struct of the same type that the table was created with.
+func (tx *Tx) GetByIndex(
+	tableName string,
+	indexName string,
+	key interface{},
+	dest interface{},
+) error {
+	if !isStructPointer(dest) {
+		return ErrGetInvalidDest
+	}
+	c, err := tx.IndexCursor(tableName, indexName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	prefix, err := c.seekKey(key)
+	if err != nil {
+		return err
+	}
+	ok, err := c.cursor.Seek(prefix)
+	if err != nil {
+		return err
+	}
+	if ok {
+		ok, err = c.hasPrefix(prefix)
+		if err != nil {
+			return err
+		}
+	}
+	if !ok {
+		return ErrKeyNotFound
+	}
+	return c.Scan(dest)
+}
+
+// Deletes the row with the given primary key.
+// For tables with more than one primary key column, key must be a Key.
+func (tx *Tx) Delete(tableName string, key interface{}) error {
+	table, err := tx.writableTable(tableName)
+	if err != nil {
+		return err
+	}
+	keyCols, err := table.keyColumns(key)
+	if err != nil {
+		return err
+	}
+	keyBytes, err := app.EncodeKey(table.schema, keyCols)
+	if err != nil {
+		return err
+	}
+	oldRow, err := table.lookupRow(keyBytes)
+	if err != nil {
+		return err
+	}
+	if oldRow == nil {
+		return ErrKeyNotFound
+	}
+	err = table.deleteIndexKeys(oldRow, keyBytes)
+	if err != nil {
+		return err
+	}
+	_, err = table.tree.Delete(keyBytes)
+	if err != nil {
+		return err
+	}
+	table.syncRoot()
+	return nil
+}